@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"context"
 	"os/exec"
 
 	logging "github.com/ipfs/go-log"
@@ -12,3 +13,10 @@ func SH(c string) (string, error) {
 	o, err := exec.Command("/bin/sh", "-c", c).CombinedOutput()
 	return string(o), err
 }
+
+// SHContext is like SH, killing sh when ctx is done.
+func SHContext(ctx context.Context, c string) (string, error) {
+	logging.Logger("sh").Debugf("Executing sh command: %s", c)
+	o, err := exec.CommandContext(ctx, "/bin/sh", "-c", c).CombinedOutput()
+	return string(o), err
+}
@@ -69,6 +69,11 @@ $ peg --iso path_to_iso_file <file.yaml>
 				Usage:  "overrides state dir in peg specfiles",
 				EnvVar: "PEG_STATE",
 			},
+			cli.StringFlag{
+				Name:   "tempdir",
+				Usage:  "directory used for temporary files, defaults to the system temp dir",
+				EnvVar: "PEG_TEMPDIR",
+			},
 			cli.StringFlag{
 				Name:   "loglevel",
 				Value:  "debug",
@@ -187,6 +192,7 @@ $ peg --iso path_to_iso_file <file.yaml>
 				types.WithDrive(c.String("drive")),
 				types.WithMemory(c.String("memory")),
 				types.WithStateDir(c.String("state")),
+				types.WithTempDir(c.String("tempdir")),
 				types.WithImage(c.String("image")),
 				types.WithISO(c.String("iso")),
 				types.WithISOChecksum(c.String("iso-checksum")),
@@ -0,0 +1,93 @@
+package matcher
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/spectrocloud/peg/pkg/machine/types"
+)
+
+// BlockDevice is a block device of the machine, as reported by lsblk.
+type BlockDevice struct {
+	Name string
+	// Size in bytes
+	Size       int64
+	Type       string
+	MountPoint string
+	FSType     string
+	Children   []BlockDevice
+}
+
+// lsblkDevice matches an entry of lsblk --json. Depending on the lsblk
+// version, sizes are reported as numbers or strings.
+type lsblkDevice struct {
+	Name       string        `json:"name"`
+	Size       json.Number   `json:"size"`
+	Type       string        `json:"type"`
+	MountPoint string        `json:"mountpoint"`
+	FSType     string        `json:"fstype"`
+	Children   []lsblkDevice `json:"children"`
+}
+
+// BlockDevices returns the tree of block devices of the machine.
+func (vm VM) BlockDevices() ([]BlockDevice, error) {
+	return machineBlockDevices(vm.target())
+}
+
+func BlockDevices() ([]BlockDevice, error) {
+	return machineBlockDevices(Machine)
+}
+
+// FindBlockDevice looks for the device called name (e.g. "vda1") in devices and their children.
+func FindBlockDevice(devices []BlockDevice, name string) (BlockDevice, bool) {
+	for _, d := range devices {
+		if d.Name == name {
+			return d, true
+		}
+		if c, ok := FindBlockDevice(d.Children, name); ok {
+			return c, true
+		}
+	}
+	return BlockDevice{}, false
+}
+
+func machineBlockDevices(m types.Machine) ([]BlockDevice, error) {
+	out, err := machineSudo(m, "lsblk --json --bytes --output NAME,SIZE,TYPE,MOUNTPOINT,FSTYPE 2>/dev/null")
+	if err != nil {
+		return nil, fmt.Errorf("listing block devices: %w - %s", err, out)
+	}
+	return parseLsblk(out)
+}
+
+func parseLsblk(out string) ([]BlockDevice, error) {
+	var res struct {
+		BlockDevices []lsblkDevice `json:"blockdevices"`
+	}
+	if err := json.Unmarshal([]byte(out), &res); err != nil {
+		return nil, fmt.Errorf("parsing lsblk output: %w - %s", err, out)
+	}
+	return toBlockDevices(res.BlockDevices)
+}
+
+func toBlockDevices(devices []lsblkDevice) ([]BlockDevice, error) {
+	res := []BlockDevice{}
+	for _, d := range devices {
+		size, err := d.Size.Int64()
+		if err != nil && d.Size != "" {
+			return nil, fmt.Errorf("invalid size %q for %s", d.Size, d.Name)
+		}
+		children, err := toBlockDevices(d.Children)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, BlockDevice{
+			Name:       d.Name,
+			Size:       size,
+			Type:       d.Type,
+			MountPoint: d.MountPoint,
+			FSType:     d.FSType,
+			Children:   children,
+		})
+	}
+	return res, nil
+}
@@ -0,0 +1,132 @@
+package matcher
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/spectrocloud/peg/pkg/machine/types"
+
+	. "github.com/onsi/gomega" //nolint:revive
+)
+
+// ErrNoSystemd is returned by the boot timing helpers on machines without systemd-analyze.
+var ErrNoSystemd = errors.New("systemd-analyze not found, boot timing requires systemd")
+
+// UnitTiming is the time a systemd unit took to start.
+type UnitTiming struct {
+	Unit     string
+	Duration time.Duration
+}
+
+// BootTime returns the time it took the machine to boot, as reported by systemd-analyze time.
+func (vm VM) BootTime() (time.Duration, error) {
+	return machineBootTime(vm.target())
+}
+
+// SlowestUnits returns the n units that took the longest to start, slowest first.
+func (vm VM) SlowestUnits(n int) ([]UnitTiming, error) {
+	return machineSlowestUnits(vm.target(), n)
+}
+
+// ExpectBootUnder asserts that the machine booted in less than d.
+func (vm VM) ExpectBootUnder(d time.Duration) {
+	machineExpectBootUnder(vm.target(), d)
+}
+
+func BootTime() (time.Duration, error) {
+	return machineBootTime(Machine)
+}
+
+func SlowestUnits(n int) ([]UnitTiming, error) {
+	return machineSlowestUnits(Machine, n)
+}
+
+func ExpectBootUnder(d time.Duration) {
+	machineExpectBootUnder(Machine, d)
+}
+
+// systemdAnalyze runs systemd-analyze with args.
+func systemdAnalyze(m types.Machine, args string) (string, error) {
+	out, err := m.Command("if command -v systemd-analyze >/dev/null 2>&1; then echo ok; fi")
+	if err != nil {
+		return "", fmt.Errorf("looking for systemd-analyze: %w - %s", err, out)
+	}
+	if strings.TrimSpace(out) != "ok" {
+		return "", ErrNoSystemd
+	}
+
+	out, err = m.Command("systemd-analyze " + args)
+	if err != nil {
+		return "", fmt.Errorf("running systemd-analyze %s: %w - %s", args, err, out)
+	}
+	return out, nil
+}
+
+// parseTimespan parses a systemd timespan, e.g. "1min 2.345s" or "678ms".
+func parseTimespan(s string) (time.Duration, error) {
+	span := strings.ReplaceAll(s, " ", "")
+	span = strings.ReplaceAll(span, "min", "m")
+	span = strings.ReplaceAll(span, "µs", "us")
+	d, err := time.ParseDuration(span)
+	if err != nil {
+		return 0, fmt.Errorf("invalid timespan %q", s)
+	}
+	return d, nil
+}
+
+func machineBootTime(m types.Machine) (time.Duration, error) {
+	out, err := systemdAnalyze(m, "time")
+	if err != nil {
+		return 0, err
+	}
+
+	// Startup finished in 1.2s (kernel) + 3.4s (userspace) = 4.6s
+	for _, l := range strings.Split(out, "\n") {
+		if !strings.HasPrefix(l, "Startup finished in ") {
+			continue
+		}
+		_, total, ok := strings.Cut(l, "= ")
+		if !ok {
+			break
+		}
+		return parseTimespan(strings.TrimSpace(total))
+	}
+	return 0, fmt.Errorf("unexpected systemd-analyze time output: %s", out)
+}
+
+func machineSlowestUnits(m types.Machine, n int) ([]UnitTiming, error) {
+	out, err := systemdAnalyze(m, "blame --no-pager")
+	if err != nil {
+		return nil, err
+	}
+
+	// Units are already sorted, slowest first, e.g. "1min 2.3s foo.service"
+	units := []UnitTiming{}
+	for _, l := range strings.Split(out, "\n") {
+		if len(units) == n {
+			break
+		}
+		fields := strings.Fields(l)
+		if len(fields) < 2 {
+			continue
+		}
+		d, err := parseTimespan(strings.Join(fields[:len(fields)-1], " "))
+		if err != nil {
+			return nil, err
+		}
+		units = append(units, UnitTiming{Unit: fields[len(fields)-1], Duration: d})
+	}
+	return units, nil
+}
+
+func machineExpectBootUnder(m types.Machine, d time.Duration) {
+	boot, err := machineBootTime(m)
+	ExpectWithOffset(2, err).ToNot(HaveOccurred())
+	if boot >= d {
+		// Point at the culprits in the failure message
+		slowest, _ := machineSlowestUnits(m, 5)
+		ExpectWithOffset(2, boot).To(BeNumerically("<", d), fmt.Sprintf("slowest units: %v", slowest))
+	}
+}
@@ -0,0 +1,60 @@
+package matcher
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/spectrocloud/peg/pkg/machine/types"
+
+	. "github.com/onsi/gomega" //nolint:revive
+)
+
+// ErrUnknownBootloader is returned when neither grub nor systemd-boot is found in the machine.
+var ErrUnknownBootloader = errors.New("no supported bootloader (grub, systemd-boot) found")
+
+// RebootToEntry reboots the machine once into the bootloader entry, e.g. a
+// grub menu entry title or a systemd-boot entry id, and waits until it's
+// reachable again. The timeout in seconds defaults to 750. With grub, the
+// one-shot entry is only honoured when GRUB_DEFAULT is "saved".
+func (vm VM) RebootToEntry(entry string, t ...int) {
+	machineRebootToEntry(vm.target(), entry, t...)
+}
+
+func RebootToEntry(entry string, t ...int) {
+	machineRebootToEntry(Machine, entry, t...)
+}
+
+// machineBootloader returns the command setting the one-shot boot entry in
+// the machine: "bootctl set-oneshot", "grub2-reboot" or "grub-reboot".
+func machineBootloader(m types.Machine) (string, error) {
+	// systemd-boot first, as grub tools may be installed without grub being used
+	out, err := machineSudo(m, `if command -v bootctl >/dev/null 2>&1 && bootctl is-installed >/dev/null 2>&1; then echo "bootctl set-oneshot"; `+
+		`elif command -v grub2-reboot >/dev/null 2>&1; then echo grub2-reboot; `+
+		`elif command -v grub-reboot >/dev/null 2>&1; then echo grub-reboot; fi`)
+	if err != nil {
+		return "", fmt.Errorf("detecting the bootloader: %w - %s", err, out)
+	}
+	if out = strings.TrimSpace(out); out == "" {
+		return "", ErrUnknownBootloader
+	}
+	return out, nil
+}
+
+func machineRebootToEntry(m types.Machine, entry string, t ...int) {
+	setOneshot, err := machineBootloader(m)
+	ExpectWithOffset(2, err).ToNot(HaveOccurred())
+
+	out, err := machineSudo(m, fmt.Sprintf("%s %s", setOneshot, shellQuote(entry)))
+	ExpectWithOffset(2, err).ToNot(HaveOccurred(), out)
+
+	timeout := 750
+	if len(t) != 0 {
+		timeout = t[0]
+	}
+	err = machineWaitForReboot(m, func() {
+		machineSudo(m, "reboot") //nolint:errcheck
+	}, time.Duration(timeout)*time.Second)
+	ExpectWithOffset(2, err).ToNot(HaveOccurred())
+}
@@ -0,0 +1,69 @@
+package matcher
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/spectrocloud/peg/pkg/machine/types"
+
+	. "github.com/onsi/gomega" //nolint:revive
+)
+
+// cdSwapper is implemented by machines able to change their CD and reset.
+type cdSwapper interface {
+	AttachCD(iso string) error
+	Reset() error
+}
+
+// SwapCDAndReboot replaces the CD of the machine with newISO, checks that the
+// guest sees the new medium and resets the machine, waiting for it to be
+// reachable again. The timeout in seconds defaults to 750. It is only supported
+// by qemu machines.
+func (vm VM) SwapCDAndReboot(newISO string, t ...int) {
+	machineSwapCDAndReboot(vm.target(), newISO, t...)
+}
+
+func SwapCDAndReboot(newISO string, t ...int) {
+	machineSwapCDAndReboot(Machine, newISO, t...)
+}
+
+// cdSizes returns the sizes of the media inserted in the CD drives of the machine.
+func cdSizes(m types.Machine) ([]int64, error) {
+	devices, err := machineBlockDevices(m)
+	if err != nil {
+		return nil, err
+	}
+	sizes := []int64{}
+	for _, d := range devices {
+		if d.Type == "rom" {
+			sizes = append(sizes, d.Size)
+		}
+	}
+	return sizes, nil
+}
+
+func machineSwapCDAndReboot(m types.Machine, newISO string, t ...int) {
+	s, ok := engine(m).(cdSwapper)
+	ExpectWithOffset(2, ok).To(BeTrue(), "swapping the CD is not supported by the %s engine", m.Config().Engine)
+
+	stat, err := os.Stat(newISO)
+	ExpectWithOffset(2, err).ToNot(HaveOccurred())
+
+	ExpectWithOffset(2, m.DetachCD()).To(Succeed())
+	ExpectWithOffset(2, s.AttachCD(newISO)).To(Succeed())
+
+	// The guest notices the medium change asynchronously
+	EventuallyWithOffset(2, func() ([]int64, error) {
+		return cdSizes(m)
+	}, 30*time.Second, 2*time.Second).Should(ContainElement(stat.Size()), fmt.Sprintf("%s is not inserted", newISO))
+
+	timeout := 750
+	if len(t) > 0 {
+		timeout = t[0]
+	}
+	err = machineWaitForReboot(m, func() {
+		ExpectWithOffset(3, s.Reset()).To(Succeed())
+	}, time.Duration(timeout)*time.Second)
+	ExpectWithOffset(2, err).ToNot(HaveOccurred())
+}
@@ -0,0 +1,89 @@
+package matcher
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spectrocloud/peg/pkg/machine/types"
+)
+
+// The Check functions are the error returning counterparts of the assertion
+// helpers, usable without Gomega.
+
+// CheckHasFile returns an error if s is not a regular file in the machine.
+func (vm VM) CheckHasFile(s string) error {
+	return machineCheckHasFile(vm.target(), s)
+}
+
+// CheckHasDir returns an error if s is not a directory in the machine.
+func (vm VM) CheckHasDir(s string) error {
+	return machineCheckHasDir(vm.target(), s)
+}
+
+// CheckCmdlineContains returns an error if the kernel command line doesn't contain substr.
+func (vm VM) CheckCmdlineContains(substr string) error {
+	return machineCheckCmdlineContains(vm.target(), substr)
+}
+
+// CheckDmesgContains returns an error if the kernel log doesn't contain substr.
+func (vm VM) CheckDmesgContains(substr string) error {
+	return machineCheckDmesgContains(vm.target(), substr)
+}
+
+func CheckHasFile(s string) error {
+	return machineCheckHasFile(Machine, s)
+}
+
+func CheckHasDir(s string) error {
+	return machineCheckHasDir(Machine, s)
+}
+
+func CheckCmdlineContains(substr string) error {
+	return machineCheckCmdlineContains(Machine, substr)
+}
+
+func CheckDmesgContains(substr string) error {
+	return machineCheckDmesgContains(Machine, substr)
+}
+
+// machineCheckTest runs test(1) with flag on s.
+func machineCheckTest(m types.Machine, flag, s, what string) error {
+	out, err := m.Command("if [ " + flag + " " + s + " ]; then echo ok; else echo wrong; fi")
+	if err != nil {
+		return fmt.Errorf("checking %s: %w - %s", s, err, out)
+	}
+	if out != "ok\n" {
+		return fmt.Errorf("%s is not %s", s, what)
+	}
+	return nil
+}
+
+func machineCheckHasFile(m types.Machine, s string) error {
+	return machineCheckTest(m, "-f", s, "a file")
+}
+
+func machineCheckHasDir(m types.Machine, s string) error {
+	return machineCheckTest(m, "-d", s, "a directory")
+}
+
+func machineCheckCmdlineContains(m types.Machine, substr string) error {
+	out, err := m.Command("cat /proc/cmdline")
+	if err != nil {
+		return fmt.Errorf("reading the kernel command line: %w - %s", err, out)
+	}
+	if !strings.Contains(out, substr) {
+		return fmt.Errorf("kernel command line %q does not contain %q", strings.TrimSpace(out), substr)
+	}
+	return nil
+}
+
+func machineCheckDmesgContains(m types.Machine, substr string) error {
+	out, err := machineSudo(m, "dmesg")
+	if err != nil {
+		return fmt.Errorf("reading the kernel log: %w - %s", err, out)
+	}
+	if !strings.Contains(out, substr) {
+		return fmt.Errorf("kernel log does not contain %q", substr)
+	}
+	return nil
+}
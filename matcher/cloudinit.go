@@ -0,0 +1,48 @@
+package matcher
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/spectrocloud/peg/pkg/machine/types"
+
+	. "github.com/onsi/gomega" //nolint:revive
+)
+
+// cloudInitResult is the file cloud-init writes once it has finished all its stages.
+const cloudInitResult = "/run/cloud-init/result.json"
+
+// WaitForCloudInit waits until cloud-init finishes, or timeout expires, and
+// asserts that it didn't report errors. SSH usually comes up before that, so
+// it should be used instead of EventuallyConnects alone on cloud-init images.
+func (vm VM) WaitForCloudInit(timeout time.Duration) {
+	machineWaitForCloudInit(vm.target(), timeout)
+}
+
+func WaitForCloudInit(timeout time.Duration) {
+	machineWaitForCloudInit(Machine, timeout)
+}
+
+func machineWaitForCloudInit(m types.Machine, timeout time.Duration) {
+	var out string
+	EventuallyWithOffset(2, func() error {
+		var err error
+		out, err = machineSudo(m, "cat "+cloudInitResult)
+		return err
+	}, timeout, 5*time.Second).Should(Succeed(), "cloud-init did not finish in time")
+
+	var result struct {
+		V1 struct {
+			Errors []string `json:"errors"`
+		} `json:"v1"`
+	}
+	ExpectWithOffset(2, json.Unmarshal([]byte(out), &result)).To(Succeed(), out)
+
+	if len(result.V1.Errors) > 0 {
+		// The detailed status points at the failing modules
+		status, _ := machineSudo(m, "cloud-init status --long")
+		ExpectWithOffset(2, result.V1.Errors).To(BeEmpty(), fmt.Sprintf("cloud-init failed:\n%s", strings.TrimSpace(status)))
+	}
+}
@@ -0,0 +1,100 @@
+package matcher
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/spectrocloud/peg/pkg/machine/types"
+
+	. "github.com/onsi/gomega" //nolint:revive
+)
+
+// GuestIPs returns the IPv4 addresses of the machine, except loopback ones.
+func (vm VM) GuestIPs() ([]string, error) {
+	return machineGuestIPs(vm.target())
+}
+
+func GuestIPs() ([]string, error) {
+	return machineGuestIPs(Machine)
+}
+
+// ExpectConnectivity asserts that from can open a TCP connection to port on
+// one of the addresses of to, or ping it when port is 0. Addresses shared by
+// both machines, like the one of qemu's user network, are not considered.
+func ExpectConnectivity(from, to VM, port int) {
+	reachable, err := connectivity(from.target(), to.target(), port)
+	ExpectWithOffset(1, err).ToNot(HaveOccurred())
+	ExpectWithOffset(1, reachable).ToNot(BeEmpty(), "%s can't reach %s on port %d", from.machine.Config().ID, to.machine.Config().ID, port)
+}
+
+// ExpectNoConnectivity asserts that from can't reach to on port, e.g. to test
+// network isolation. A port of 0 checks that to doesn't answer pings.
+func ExpectNoConnectivity(from, to VM, port int) {
+	reachable, err := connectivity(from.target(), to.target(), port)
+	ExpectWithOffset(1, err).ToNot(HaveOccurred())
+	ExpectWithOffset(1, reachable).To(BeEmpty(), "%s can reach %s on port %d", from.machine.Config().ID, to.machine.Config().ID, port)
+}
+
+func machineGuestIPs(m types.Machine) ([]string, error) {
+	var links []struct {
+		AddrInfo []struct {
+			Local string `json:"local"`
+		} `json:"addr_info"`
+	}
+	if err := machineCommandJSON(m, "ip -j -4 addr show", &links); err != nil {
+		return nil, err
+	}
+
+	ips := []string{}
+	for _, l := range links {
+		for _, a := range l.AddrInfo {
+			if ip := net.ParseIP(a.Local); ip != nil && !ip.IsLoopback() {
+				ips = append(ips, a.Local)
+			}
+		}
+	}
+	return ips, nil
+}
+
+// connectivity returns the addresses of to which from can reach on port.
+func connectivity(from, to types.Machine, port int) ([]string, error) {
+	fromIPs, err := machineGuestIPs(from)
+	if err != nil {
+		return nil, fmt.Errorf("listing addresses of %s: %w", from.Config().ID, err)
+	}
+	toIPs, err := machineGuestIPs(to)
+	if err != nil {
+		return nil, fmt.Errorf("listing addresses of %s: %w", to.Config().ID, err)
+	}
+
+	own := map[string]bool{}
+	for _, ip := range fromIPs {
+		own[ip] = true
+	}
+
+	reachable := []string{}
+	candidates := 0
+	for _, ip := range toIPs {
+		if own[ip] {
+			continue
+		}
+		candidates++
+
+		var check string
+		if port == 0 {
+			check = fmt.Sprintf("ping -c 1 -W 5 %s", ip)
+		} else {
+			addr := strconv.Itoa(port)
+			check = fmt.Sprintf("if command -v nc >/dev/null 2>&1; then nc -z -w 5 %[1]s %[2]s; "+
+				"else timeout 5 bash -c 'exec 3<>/dev/tcp/%[1]s/%[2]s'; fi", ip, addr)
+		}
+		if _, err := from.Command(check); err == nil {
+			reachable = append(reachable, ip)
+		}
+	}
+	if candidates == 0 {
+		return nil, fmt.Errorf("%s has no address of its own, connect the machines with a shared network", to.Config().ID)
+	}
+	return reachable, nil
+}
@@ -0,0 +1,52 @@
+package matcher
+
+import (
+	"fmt"
+
+	"github.com/spectrocloud/peg/pkg/machine/types"
+)
+
+// prepareDataDiskScript partitions $dev, formats the partition as $fstype and
+// mounts it in $mountpoint, or enables it as swap. Steps already done, e.g.
+// on a second run, are skipped.
+const prepareDataDiskScript = `set -e
+part=$(lsblk -lnpo NAME,TYPE "$dev" | awk '$2 == "part" { print $1; exit }')
+if [ -z "$part" ]; then
+	echo ',,L' | sfdisk -q --label gpt "$dev"
+	udevadm settle || true
+	part=$(lsblk -lnpo NAME,TYPE "$dev" | awk '$2 == "part" { print $1; exit }')
+fi
+if ! blkid "$part" >/dev/null 2>&1; then
+	if [ "$fstype" = swap ]; then mkswap "$part"; else mkfs -t "$fstype" "$part" </dev/null; fi
+fi
+if [ "$fstype" = swap ]; then
+	grep -q "^$part " /proc/swaps || swapon "$part"
+else
+	mkdir -p "$mountpoint"
+	mountpoint -q "$mountpoint" || mount "$part" "$mountpoint"
+fi`
+
+// PrepareDataDisk partitions the blank disk device, formats it as fstype and
+// mounts it in mountpoint, which is ignored for "swap". A disk which is
+// already formatted is not formatted again.
+func (vm VM) PrepareDataDisk(device, fstype, mountpoint string) error {
+	return machinePrepareDataDisk(vm.target(), device, fstype, mountpoint)
+}
+
+func PrepareDataDisk(device, fstype, mountpoint string) error {
+	return machinePrepareDataDisk(Machine, device, fstype, mountpoint)
+}
+
+func machinePrepareDataDisk(m types.Machine, device, fstype, mountpoint string) error {
+	if fstype != "swap" && mountpoint == "" {
+		return fmt.Errorf("a mountpoint is required for %s", fstype)
+	}
+
+	script := fmt.Sprintf("dev=%s fstype=%s mountpoint=%s\n%s",
+		shellQuote(device), shellQuote(fstype), shellQuote(mountpoint), prepareDataDiskScript)
+	out, err := machineSudo(m, script)
+	if err != nil {
+		return fmt.Errorf("preparing %s: %w - %s", device, err, out)
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package matcher
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spectrocloud/peg/pkg/machine/types"
+
+	. "github.com/onsi/gomega" //nolint:revive
+)
+
+// DiskUsage returns the total, used and available bytes of the filesystem containing path.
+func (vm VM) DiskUsage(path string) (total, used, avail int64, err error) {
+	return machineDiskUsage(vm.target(), path)
+}
+
+// EventuallyDiskUsageBelow waits until the used space of the filesystem
+// containing path is below bytes. The timeout in seconds defaults to 60.
+func (vm VM) EventuallyDiskUsageBelow(path string, bytes int64, t ...int) {
+	machineEventuallyDiskUsageBelow(vm.target(), path, bytes, t...)
+}
+
+func DiskUsage(path string) (total, used, avail int64, err error) {
+	return machineDiskUsage(Machine, path)
+}
+
+func EventuallyDiskUsageBelow(path string, bytes int64, t ...int) {
+	machineEventuallyDiskUsageBelow(Machine, path, bytes, t...)
+}
+
+func machineDiskUsage(m types.Machine, path string) (total, used, avail int64, err error) {
+	// -P keeps each filesystem on a single line, even with long device names
+	out, err := machineSudo(m, fmt.Sprintf("df -B1 -P %s", shellQuote(path)))
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("getting disk usage of %s: %w - %s", path, err, out)
+	}
+	return parseDf(out)
+}
+
+// parseDf parses the output of df -B1 -P for a single path.
+func parseDf(out string) (total, used, avail int64, err error) {
+	// The last filesystem listed is the one containing the path
+	var fields []string
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		if f := strings.Fields(line); len(f) >= 6 && f[0] != "Filesystem" {
+			fields = f
+		}
+	}
+	if fields == nil {
+		return 0, 0, 0, fmt.Errorf("unexpected df output: %s", out)
+	}
+
+	values := make([]int64, 3)
+	for i := range values {
+		values[i], err = strconv.ParseInt(fields[i+1], 10, 64)
+		if err != nil {
+			return 0, 0, 0, fmt.Errorf("unexpected df output: %s", out)
+		}
+	}
+	return values[0], values[1], values[2], nil
+}
+
+func machineEventuallyDiskUsageBelow(m types.Machine, path string, bytes int64, t ...int) {
+	timeout := 60
+	if len(t) > 0 {
+		timeout = t[0]
+	}
+	EventuallyWithOffset(2, func() (int64, error) {
+		_, used, _, err := machineDiskUsage(m, path)
+		return used, err
+	}, time.Duration(timeout)*time.Second, 5*time.Second).Should(BeNumerically("<", bytes), "disk usage of %s", path)
+}
@@ -0,0 +1,48 @@
+package matcher
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/spectrocloud/peg/pkg/machine/types"
+
+	. "github.com/onsi/gomega" //nolint:revive
+	gomegatypes "github.com/onsi/gomega/types"
+)
+
+// EventuallyCommandOutput runs cmd every 5 seconds until its output matches
+// matcher, e.g. ContainSubstring("active"). The timeout in seconds defaults to 120.
+func (vm VM) EventuallyCommandOutput(cmd string, matcher gomegatypes.GomegaMatcher, t ...int) {
+	machineEventuallyCommandOutput(vm.target(), cmd, matcher, t...)
+}
+
+func EventuallyCommandOutput(cmd string, matcher gomegatypes.GomegaMatcher, t ...int) {
+	machineEventuallyCommandOutput(Machine, cmd, matcher, t...)
+}
+
+func machineEventuallyCommandOutput(m types.Machine, cmd string, matcher gomegatypes.GomegaMatcher, t ...int) {
+	timeout := 120
+	if len(t) > 0 {
+		timeout = t[0]
+	}
+	eventuallyOutput(3, m, cmd, matcher, time.Duration(timeout)*time.Second,
+		fmt.Sprintf("Still waiting for the output of %q...", cmd), fmt.Sprintf("Output of %q did not match in time", cmd))
+}
+
+// eventuallyOutput polls cmd until its output matches matcher or timeout
+// expires, printing progress every 30 seconds. offset is the number of
+// callers to skip when reporting the failure.
+func eventuallyOutput(offset int, m types.Machine, cmd string, matcher gomegatypes.GomegaMatcher, timeout time.Duration, progress, failure string) {
+	var lastPrint time.Time
+	EventuallyWithOffset(offset, func() string {
+		// Every 30 seconds print a message to show progress
+		now := time.Now()
+		if lastPrint.IsZero() || now.Sub(lastPrint) >= 30*time.Second {
+			fmt.Println(progress)
+			lastPrint = now
+		}
+
+		out, _ := m.Command(cmd)
+		return out
+	}, timeout, 5*time.Second).Should(matcher, failure)
+}
@@ -0,0 +1,70 @@
+package matcher
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/spectrocloud/peg/pkg/machine/types"
+
+	. "github.com/onsi/gomega" //nolint:revive
+)
+
+// ErrFileMissing is returned when the file to check doesn't exist in the machine.
+var ErrFileMissing = errors.New("file does not exist")
+
+// statMissing is printed instead of the stat output when the file doesn't exist.
+const statMissing = "peg-missing"
+
+// ExpectFileMode asserts that the permissions of path, in octal as printed
+// by `stat -c %a` (e.g. "644" or "4755"), are mode. A leading zero in mode
+// is ignored.
+func (vm VM) ExpectFileMode(path, mode string) {
+	machineExpectFileMode(vm.target(), path, mode)
+}
+
+// ExpectFileOwner asserts that path is owned by the user owner and the group group.
+func (vm VM) ExpectFileOwner(path, owner, group string) {
+	machineExpectFileOwner(vm.target(), path, owner, group)
+}
+
+func ExpectFileMode(path, mode string) {
+	machineExpectFileMode(Machine, path, mode)
+}
+
+func ExpectFileOwner(path, owner, group string) {
+	machineExpectFileOwner(Machine, path, owner, group)
+}
+
+// machineStat returns the output of stat with format for path, wrapping
+// ErrFileMissing if it doesn't exist. Symlinks are not followed.
+func machineStat(m types.Machine, path, format string) (string, error) {
+	out, err := machineSudo(m, fmt.Sprintf("if [ -e %[1]s ] || [ -L %[1]s ]; then stat -c %[2]s %[1]s; else echo %[3]s; fi",
+		shellQuote(path), shellQuote(format), statMissing))
+	if err != nil {
+		return "", fmt.Errorf("running stat on %s: %w - %s", path, err, out)
+	}
+	out = strings.TrimSpace(out)
+	if out == statMissing {
+		return "", fmt.Errorf("%w: %s", ErrFileMissing, path)
+	}
+	return out, nil
+}
+
+func machineExpectFileMode(m types.Machine, path, mode string) {
+	want, err := strconv.ParseUint(mode, 8, 32)
+	ExpectWithOffset(2, err).ToNot(HaveOccurred(), "invalid mode %q", mode)
+
+	out, err := machineStat(m, path, "%a")
+	ExpectWithOffset(2, err).ToNot(HaveOccurred())
+	got, err := strconv.ParseUint(out, 8, 32)
+	ExpectWithOffset(2, err).ToNot(HaveOccurred(), "unexpected stat output for %s: %s", path, out)
+	ExpectWithOffset(2, fmt.Sprintf("%o", got)).To(Equal(fmt.Sprintf("%o", want)), "mode of %s", path)
+}
+
+func machineExpectFileOwner(m types.Machine, path, owner, group string) {
+	out, err := machineStat(m, path, "%U:%G")
+	ExpectWithOffset(2, err).ToNot(HaveOccurred())
+	ExpectWithOffset(2, out).To(Equal(owner+":"+group), "owner of %s", path)
+}
@@ -0,0 +1,57 @@
+package matcher
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/spectrocloud/peg/pkg/machine/types"
+
+	. "github.com/onsi/gomega" //nolint:revive
+)
+
+// WithFirewallRule applies rule, a full nft, iptables or ip6tables command
+// (e.g. "iptables -A INPUT -p tcp --dport 80 -j DROP"), runs f and then restores
+// the ruleset as it was before the rule was applied, even if f panics.
+func (vm VM) WithFirewallRule(rule string, f func()) {
+	machineWithFirewallRule(vm.target(), rule, f)
+}
+
+func WithFirewallRule(rule string, f func()) {
+	machineWithFirewallRule(Machine, rule, f)
+}
+
+// firewallSaveRestore returns the commands saving and restoring the ruleset
+// changed by rule, using file to store it.
+func firewallSaveRestore(rule, file string) (string, string, error) {
+	fields := strings.Fields(rule)
+	if len(fields) == 0 {
+		return "", "", fmt.Errorf("empty firewall rule")
+	}
+	switch fields[0] {
+	case "nft":
+		return "nft list ruleset > " + file, fmt.Sprintf("nft flush ruleset && nft -f %s", file), nil
+	case "iptables", "ip6tables":
+		return fmt.Sprintf("%s-save > %s", fields[0], file), fmt.Sprintf("%s-restore < %s", fields[0], file), nil
+	}
+	return "", "", fmt.Errorf("unsupported firewall command %q, expected nft, iptables or ip6tables", fields[0])
+}
+
+func machineWithFirewallRule(m types.Machine, rule string, f func()) {
+	file := fmt.Sprintf("/tmp/peg-ruleset-%d", time.Now().UnixNano())
+	save, restore, err := firewallSaveRestore(rule, file)
+	ExpectWithOffset(2, err).ToNot(HaveOccurred())
+
+	out, err := machineSudo(m, save)
+	ExpectWithOffset(2, err).ToNot(HaveOccurred(), "saving the ruleset: %s", out)
+
+	defer func() {
+		out, err := machineSudo(m, fmt.Sprintf("%s && rm -f %s", restore, file))
+		ExpectWithOffset(3, err).ToNot(HaveOccurred(), "restoring the ruleset: %s", out)
+	}()
+
+	out, err = machineSudo(m, rule)
+	ExpectWithOffset(2, err).ToNot(HaveOccurred(), "applying %q: %s", rule, out)
+
+	f()
+}
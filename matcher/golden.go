@@ -0,0 +1,158 @@
+package matcher
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spectrocloud/peg/pkg/machine/types"
+
+	. "github.com/onsi/gomega" //nolint:revive
+)
+
+// UpdateGolden makes ExpectFileMatchesLocal rewrite the golden files with the
+// content of the remote files instead of comparing them. It is set when the
+// PEG_UPDATE_GOLDEN environment variable is not empty.
+var UpdateGolden = os.Getenv("PEG_UPDATE_GOLDEN") != ""
+
+// diffContext is the number of unchanged lines around the changes in a diff.
+const diffContext = 3
+
+// ExpectFileMatchesLocal asserts that the file remotePath of the machine has
+// the same content as the local file localGoldenPath, showing a unified diff
+// otherwise. See UpdateGolden to refresh the golden files.
+func (vm VM) ExpectFileMatchesLocal(remotePath, localGoldenPath string) {
+	machineExpectFileMatchesLocal(vm.target(), remotePath, localGoldenPath)
+}
+
+func ExpectFileMatchesLocal(remotePath, localGoldenPath string) {
+	machineExpectFileMatchesLocal(Machine, remotePath, localGoldenPath)
+}
+
+func machineExpectFileMatchesLocal(m types.Machine, remotePath, localGoldenPath string) {
+	tmp, err := os.MkdirTemp(tempDir(m), "peg-golden")
+	ExpectWithOffset(2, err).ToNot(HaveOccurred())
+	defer os.RemoveAll(tmp)
+
+	received := filepath.Join(tmp, filepath.Base(remotePath))
+	ExpectWithOffset(2, m.ReceiveFile(remotePath, received)).To(Succeed())
+	got, err := os.ReadFile(received)
+	ExpectWithOffset(2, err).ToNot(HaveOccurred())
+
+	if UpdateGolden {
+		ExpectWithOffset(2, os.WriteFile(localGoldenPath, got, 0644)).To(Succeed())
+		return
+	}
+
+	want, err := os.ReadFile(localGoldenPath)
+	ExpectWithOffset(2, err).ToNot(HaveOccurred())
+	if !bytes.Equal(got, want) {
+		ExpectWithOffset(2, string(got)).To(Equal(string(want)), fmt.Sprintf("%s doesn't match %s:\n%s", remotePath, localGoldenPath,
+			unifiedDiff(localGoldenPath, remotePath, string(want), string(got))))
+	}
+}
+
+// splitLines splits s in lines, keeping their line breaks.
+func splitLines(s string) []string {
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// unifiedDiff returns the line based unified diff from a to b.
+func unifiedDiff(nameA, nameB, a, b string) string {
+	x, y := splitLines(a), splitLines(b)
+
+	// lcs[i][j] is the length of the longest common subsequence of x[i:] and y[j:]
+	lcs := make([][]int, len(x)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(y)+1)
+	}
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			if x[i] == y[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	// The edit script, one op per line: ' ' kept, '-' removed from a, '+' added from b
+	type edit struct {
+		op   byte
+		line string
+		i, j int // positions in x and y before the op
+	}
+	var edits []edit
+	i, j := 0, 0
+	for i < len(x) || j < len(y) {
+		switch {
+		case i < len(x) && j < len(y) && x[i] == y[j]:
+			edits = append(edits, edit{' ', x[i], i, j})
+			i++
+			j++
+		case i < len(x) && (j == len(y) || lcs[i+1][j] >= lcs[i][j+1]):
+			edits = append(edits, edit{'-', x[i], i, j})
+			i++
+		default:
+			edits = append(edits, edit{'+', y[j], i, j})
+			j++
+		}
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "--- %s\n+++ %s\n", nameA, nameB)
+	for start := 0; start < len(edits); {
+		// Find the next change and grow the hunk while changes are close enough
+		first := start
+		for first < len(edits) && edits[first].op == ' ' {
+			first++
+		}
+		if first == len(edits) {
+			break
+		}
+		from := max(first-diffContext, start)
+		to := first
+		for k := first; k < len(edits); k++ {
+			if edits[k].op != ' ' {
+				to = k + 1
+			} else if k-to >= 2*diffContext {
+				break
+			}
+		}
+		to = min(to+diffContext, len(edits))
+
+		countA, countB := 0, 0
+		for _, e := range edits[from:to] {
+			if e.op != '+' {
+				countA++
+			}
+			if e.op != '-' {
+				countB++
+			}
+		}
+		// An empty range starts at the line before it, like diff -u does
+		startA, startB := edits[from].i+1, edits[from].j+1
+		if countA == 0 {
+			startA--
+		}
+		if countB == 0 {
+			startB--
+		}
+		fmt.Fprintf(&sb, "@@ -%d,%d +%d,%d @@\n", startA, countA, startB, countB)
+		for _, e := range edits[from:to] {
+			sb.WriteByte(e.op)
+			sb.WriteString(e.line)
+			if !strings.HasSuffix(e.line, "\n") {
+				sb.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		start = to
+	}
+	return sb.String()
+}
@@ -0,0 +1,44 @@
+package matcher
+
+import (
+	"fmt"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// numbered returns the lines from 1 to n, replacing the ones in changed.
+func numbered(n int, changed map[int]string) string {
+	var sb strings.Builder
+	for i := 1; i <= n; i++ {
+		if c, ok := changed[i]; ok {
+			fmt.Fprintln(&sb, c)
+		} else {
+			fmt.Fprintln(&sb, i)
+		}
+	}
+	return sb.String()
+}
+
+var _ = Describe("unifiedDiff", func() {
+	DescribeTable("diffs lines",
+		func(a, b, want string) {
+			Expect(unifiedDiff("want", "got", a, b)).To(Equal("--- want\n+++ got\n" + want))
+		},
+		Entry("identical inputs", "a\nb\n", "a\nb\n", ""),
+		Entry("pure insert", "a\nb\n", "a\nx\nb\n", "@@ -1,2 +1,3 @@\n a\n+x\n b\n"),
+		Entry("insert in empty input", "", "a\n", "@@ -0,0 +1,1 @@\n+a\n"),
+		Entry("pure delete", "a\nx\nb\n", "a\nb\n", "@@ -1,3 +1,2 @@\n a\n-x\n b\n"),
+		Entry("delete everything", "a\n", "", "@@ -1,1 +0,0 @@\n-a\n"),
+		Entry("change in the middle, trimming the context",
+			numbered(10, nil), numbered(10, map[int]string{5: "five"}),
+			"@@ -2,7 +2,7 @@\n 2\n 3\n 4\n-5\n+five\n 6\n 7\n 8\n"),
+		Entry("distant changes in separate hunks",
+			numbered(20, nil), numbered(20, map[int]string{2: "two", 18: "eighteen"}),
+			"@@ -1,5 +1,5 @@\n 1\n-2\n+two\n 3\n 4\n 5\n"+
+				"@@ -15,6 +15,6 @@\n 15\n 16\n 17\n-18\n+eighteen\n 19\n 20\n"),
+		Entry("missing trailing newline", "a\nb\n", "a\nb",
+			"@@ -1,2 +1,2 @@\n a\n-b\n+b\n\\ No newline at end of file\n"),
+	)
+})
@@ -7,9 +7,11 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/onsi/ginkgo/v2"
 	"github.com/pkg/errors"
 	"github.com/spectrocloud/peg/pkg/controller"
 	"github.com/spectrocloud/peg/pkg/machine/types"
@@ -22,37 +24,88 @@ type VM struct {
 	machine    types.Machine
 	cancelFunc context.CancelFunc // We call it when we `Destroy` the VM
 	StateDir   string
+
+	// CommandTimeout bounds each command run by the helpers, which fail with
+	// a "command timed out" error when exceeded. Zero disables it.
+	CommandTimeout time.Duration
+
+	// shared between copies of the VM
+	stats *vmStats
+}
+
+type vmStats struct {
+	sync.Mutex
+	lastBootDuration time.Duration
 }
 
 func NewVM(m types.Machine, s string) VM {
 	return VM{
-		machine:  m,
-		StateDir: s,
+		machine:        m,
+		StateDir:       s,
+		CommandTimeout: DefaultCommandTimeout,
+		stats:          &vmStats{},
+	}
+}
+
+// LastBootDuration returns how long the last EventuallyConnects took for the
+// machine to become reachable, or 0 if it never succeeded.
+func (vm VM) LastBootDuration() time.Duration {
+	if vm.stats == nil {
+		return 0
 	}
+	vm.stats.Lock()
+	defer vm.stats.Unlock()
+	return vm.stats.lastBootDuration
 }
 
 func (vm VM) HasFile(s string) {
-	machineHasFile(vm.machine, s)
+	machineHasFile(vm.target(), s)
 }
 
 func (vm VM) Sudo(s string) (string, error) {
-	return machineSudo(vm.machine, s)
+	return machineSudo(vm.target(), s)
+}
+
+// SudoOut runs c as root, fails the test if it errors and returns the trimmed output.
+func (vm VM) SudoOut(c string) string {
+	return machineSudoOut(vm.target(), c)
+}
+
+// Out runs c, fails the test if it errors and returns the trimmed output.
+func (vm VM) Out(c string) string {
+	return machineOut(vm.target(), c)
 }
 
 func (vm VM) Scp(s, d, permissions string) error {
-	return machineScp(vm.machine, s, d, permissions)
+	return machineScp(vm.target(), s, d, permissions)
 }
 
 func (vm VM) Screenshot() (string, error) {
-	return machineScreenshot(vm.machine)
+	return machineScreenshot(vm.target())
 }
 
 func (vm VM) EventuallyConnects(t ...int) {
-	machineEventuallyConnects(vm.machine, t...)
+	d := machineEventuallyConnects(vm.target(), t...)
+	if vm.stats != nil {
+		vm.stats.Lock()
+		vm.stats.lastBootDuration = d
+		vm.stats.Unlock()
+	}
 }
 
 func (vm VM) Reboot(t ...int) {
-	machineReboot(vm.machine, t...)
+	machineReboot(vm.target(), t...)
+}
+
+// WaitForReboot runs trigger, e.g. a function running "reboot" in the machine,
+// and waits until the machine is reachable again after booting, or timeout expires.
+func (vm VM) WaitForReboot(trigger func(), timeout time.Duration) error {
+	return machineWaitForReboot(vm.target(), trigger, timeout)
+}
+
+// Stable asserts that the output of cmd doesn't change across a reboot.
+func (vm VM) Stable(cmd string, t ...int) {
+	machineStable(vm.target(), cmd, t...)
 }
 
 func (vm VM) DetachCD() error {
@@ -60,15 +113,38 @@ func (vm VM) DetachCD() error {
 }
 
 func (vm VM) HasDir(s string) {
-	machineHasDir(vm.machine, s)
+	machineHasDir(vm.target(), s)
+}
+
+// SetHostname changes the hostname of the running guest. It uses hostnamectl when
+// available, falling back to writing /etc/hostname. No reboot is required.
+func (vm VM) SetHostname(name string) error {
+	return machineSetHostname(vm.target(), name)
+}
+
+// CmdlineContains asserts that the kernel command line contains substr.
+func (vm VM) CmdlineContains(substr string) {
+	machineCmdlineContains(vm.target(), substr)
+}
+
+// DmesgContains asserts that the kernel log contains substr. If a timeout in
+// seconds is given, it keeps checking until then.
+func (vm VM) DmesgContains(substr string, t ...int) {
+	machineDmesgContains(vm.target(), substr, t...)
 }
 
 func (vm VM) GatherLog(logPath string) {
-	machineGatherLog(vm.machine, logPath)
+	machineGatherLog(vm.target(), logPath)
+}
+
+// GatherServiceLogs gathers the journal of the given services, limited to the
+// entries of the last since duration. A zero since gathers the whole journal.
+func (vm VM) GatherServiceLogs(services []string, since time.Duration) {
+	machineGatherServiceLogs(vm.target(), services, since)
 }
 
 func (vm VM) GatherAllLogs(services []string, logFiles []string) {
-	machineGatherAllLogs(vm.machine, services, logFiles)
+	machineGatherAllLogs(vm.target(), services, logFiles)
 }
 
 func (vm *VM) Start(ctx context.Context) (context.Context, error) {
@@ -104,6 +180,23 @@ func (vm VM) Destroy(additionalCleanup func(vm VM)) error {
 	return nil
 }
 
+// RegisterCleanup destroys the VM when the current spec ends (or the suite, when
+// called from BeforeSuite), using Ginkgo's DeferCleanup so it runs even if the spec
+// panics. onFailure callbacks run before destroying the VM only if the spec failed,
+// e.g. to gather logs. Use Destroy outside of Ginkgo.
+func (vm *VM) RegisterCleanup(onFailure ...func(vm VM)) {
+	ginkgo.DeferCleanup(func() {
+		_ = vm.Destroy(func(vm VM) {
+			if !ginkgo.CurrentSpecReport().Failed() {
+				return
+			}
+			for _, f := range onFailure {
+				f(vm)
+			}
+		})
+	})
+}
+
 var Machine types.Machine
 
 func HasFile(s string) {
@@ -114,6 +207,14 @@ func Reboot(t ...int) {
 	machineReboot(Machine, t...)
 }
 
+func WaitForReboot(trigger func(), timeout time.Duration) error {
+	return machineWaitForReboot(Machine, trigger, timeout)
+}
+
+func Stable(cmd string, t ...int) {
+	machineStable(Machine, cmd, t...)
+}
+
 func DetachCD() error {
 	return machineDetachCD(Machine)
 }
@@ -130,10 +231,30 @@ func Sudo(c string) (string, error) {
 	return machineSudo(Machine, c)
 }
 
+func SudoOut(c string) string {
+	return machineSudoOut(Machine, c)
+}
+
+func Out(c string) string {
+	return machineOut(Machine, c)
+}
+
 func Screenshot() (string, error) {
 	return machineScreenshot(Machine)
 }
 
+func SetHostname(name string) error {
+	return machineSetHostname(Machine, name)
+}
+
+func CmdlineContains(substr string) {
+	machineCmdlineContains(Machine, substr)
+}
+
+func DmesgContains(substr string, t ...int) {
+	machineDmesgContains(Machine, substr, t...)
+}
+
 func Scp(s, d, permissions string) error {
 	return machineScp(Machine, s, d, permissions)
 }
@@ -143,6 +264,11 @@ func GatherAllLogs(services []string, logFiles []string) {
 	machineGatherAllLogs(Machine, services, logFiles)
 }
 
+// GatherServiceLogs gathers the journal of the given services for the last since duration.
+func GatherServiceLogs(services []string, since time.Duration) {
+	machineGatherServiceLogs(Machine, services, since)
+}
+
 // GatherLog will try to scp the given log from the machine to a local file.
 func GatherLog(logPath string) {
 	machineGatherLog(Machine, logPath)
@@ -188,9 +314,24 @@ func machineGatherLog(m types.Machine, logPath string) {
 }
 
 func machineHasFile(m types.Machine, s string) {
-	out, err := m.Command("if [ -f " + s + " ]; then echo ok; else echo wrong; fi")
-	Expect(err).ToNot(HaveOccurred())
-	Expect(out).Should(Equal("ok\n"))
+	Expect(machineCheckHasFile(m, s)).To(Succeed())
+}
+
+// machineShell returns the shell used to run commands as root in the machine.
+func machineShell(m types.Machine) string {
+	if s := m.Config().SSH; s != nil && s.Shell != "" {
+		return s.Shell
+	}
+	return "/bin/sh"
+}
+
+// tempDir returns the directory for local scratch files of the helpers, the
+// TempDir of the machine config if set.
+func tempDir(m types.Machine) string {
+	if d := m.Config().TempDir; d != "" {
+		return d
+	}
+	return os.TempDir()
 }
 
 func machineSudo(m types.Machine, c string) (string, error) {
@@ -231,7 +372,9 @@ func machineSudo(m types.Machine, c string) (string, error) {
 		stdInPipe.Close()
 	}()
 
-	err = session.Run(`sudo /bin/sh`)
+	err = runWithTimeout(m, client, c, func() error {
+		return session.Run("sudo " + controller.WrapCommand(m, machineShell(m)))
+	})
 
 	_, copyErr := io.Copy(&outBuf, stdOutPipe)
 	if copyErr != nil {
@@ -245,6 +388,18 @@ func machineSudo(m types.Machine, c string) (string, error) {
 	return outBuf.String(), err
 }
 
+func machineSudoOut(m types.Machine, c string) string {
+	out, err := machineSudo(m, c)
+	ExpectWithOffset(2, err).ToNot(HaveOccurred(), out)
+	return strings.TrimSpace(out)
+}
+
+func machineOut(m types.Machine, c string) string {
+	out, err := m.Command(c)
+	ExpectWithOffset(2, err).ToNot(HaveOccurred(), out)
+	return strings.TrimSpace(out)
+}
+
 func machineScp(m types.Machine, s, d, permissions string) error {
 	return m.SendFile(s, d, permissions)
 }
@@ -253,33 +408,98 @@ func machineScreenshot(m types.Machine) (string, error) {
 	return m.Screenshot()
 }
 
-func machineEventuallyConnects(m types.Machine, t ...int) {
+// machineEventuallyConnects waits for the machine to be reachable and returns how long it took.
+func machineEventuallyConnects(m types.Machine, t ...int) time.Duration {
 	dur := 360
 	if len(t) > 0 {
 		dur = t[0]
 	}
-	var lastPrint time.Time
-	Eventually(func() string {
-		// Every 30 seconds print a message to show progress
-		now := time.Now()
-		if lastPrint.IsZero() || now.Sub(lastPrint) >= 30*time.Second {
-			fmt.Println("Still trying to connect...")
-			lastPrint = now
-		}
-
-		out, _ := m.Command("echo ping")
-		return out
-	}, time.Duration(dur)*time.Second, 5*time.Second).Should(Equal("ping\n"), "Machine did not become reachable in time")
+	start := time.Now()
+	eventuallyOutput(1, m, "echo ping", Equal("ping\n"), time.Duration(dur)*time.Second,
+		"Still trying to connect...", "Machine did not become reachable in time")
+	m.Config().Emit(types.EventSSHReady, m.Config().SSH.Port)
+	return time.Since(start)
 }
 
 func machineReboot(m types.Machine, t ...int) {
-	machineSudo(m, "reboot") //nolint:errcheck
-	time.Sleep(1 * time.Minute)
 	timeout := 750
 	if len(t) != 0 {
 		timeout = t[0]
 	}
-	machineEventuallyConnects(m, timeout)
+	err := machineWaitForReboot(m, func() {
+		machineSudo(m, "reboot") //nolint:errcheck
+	}, time.Duration(timeout)*time.Second)
+	Expect(err).ToNot(HaveOccurred())
+}
+
+// machineBootID returns the id of the current boot of the machine, which changes on every boot.
+func machineBootID(m types.Machine) (string, error) {
+	out, err := m.Command("cat /proc/sys/kernel/random/boot_id")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(out), nil
+}
+
+func machineWaitForReboot(m types.Machine, trigger func(), timeout time.Duration) error {
+	before, err := machineBootID(m)
+	if err != nil {
+		return fmt.Errorf("reading boot id: %w", err)
+	}
+
+	trigger()
+
+	deadline := time.Now().Add(timeout)
+	lastPrint := time.Now()
+	for {
+		// SSH can still answer for a while after the trigger, only a new boot id means the machine rebooted
+		if id, err := machineBootID(m); err == nil && id != "" && id != before {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("machine did not reboot in %s", timeout)
+		}
+		if time.Since(lastPrint) >= 30*time.Second {
+			fmt.Println("Still waiting for the machine to reboot...")
+			lastPrint = time.Now()
+		}
+		time.Sleep(5 * time.Second)
+	}
+}
+
+func machineSetHostname(m types.Machine, name string) error {
+	out, err := machineSudo(m, fmt.Sprintf(
+		"if command -v hostnamectl >/dev/null 2>&1; then hostnamectl set-hostname %[1]s; else echo %[1]s > /etc/hostname && hostname %[1]s; fi", shellQuote(name)))
+	if err != nil {
+		return fmt.Errorf("setting hostname to %s: %w - %s", name, err, out)
+	}
+	return nil
+}
+
+func machineStable(m types.Machine, cmd string, t ...int) {
+	before, err := m.Command(cmd)
+	Expect(err).ToNot(HaveOccurred(), before)
+
+	machineReboot(m, t...)
+
+	after, err := m.Command(cmd)
+	Expect(err).ToNot(HaveOccurred(), after)
+	Expect(after).To(Equal(before), "output of %q changed across reboot\nbefore:\n%s\nafter:\n%s", cmd, before, after)
+}
+
+func machineCmdlineContains(m types.Machine, substr string) {
+	Expect(machineCheckCmdlineContains(m, substr)).To(Succeed())
+}
+
+func machineDmesgContains(m types.Machine, substr string, t ...int) {
+	if len(t) == 0 {
+		Expect(machineCheckDmesgContains(m, substr)).To(Succeed())
+		return
+	}
+
+	Eventually(func() error {
+		return machineCheckDmesgContains(m, substr)
+	}, time.Duration(t[0])*time.Second, 5*time.Second).Should(Succeed())
 }
 
 func machineDetachCD(m types.Machine) error {
@@ -287,21 +507,29 @@ func machineDetachCD(m types.Machine) error {
 }
 
 func machineHasDir(m types.Machine, s string) {
-	out, err := m.Command("if [ -d " + s + " ]; then echo ok; else echo wrong; fi")
-	Expect(err).ToNot(HaveOccurred())
-	Expect(out).Should(Equal("ok\n"))
+	Expect(machineCheckHasDir(m, s)).To(Succeed())
 }
 
-func machineGatherAllLogs(m types.Machine, services []string, logFiles []string) {
-	// services
+func machineGatherServiceLogs(m types.Machine, services []string, since time.Duration) {
+	sinceArg := ""
+	if since > 0 {
+		// journalctl takes whole seconds, round up so that nothing is missed
+		sinceArg = fmt.Sprintf(" --since=-%ds", (since+time.Second-1)/time.Second)
+	}
 	for _, ser := range services {
-		out, err := machineSudo(m, fmt.Sprintf("journalctl -u %s -o short-iso >> /run/%s.log", ser, ser))
+		logPath := fmt.Sprintf("/run/%s.log", ser)
+		out, err := machineSudo(m, fmt.Sprintf("journalctl -u %s -o short-iso%s > %s", shellQuote(ser), sinceArg, shellQuote(logPath)))
 		if err != nil {
 			fmt.Printf("Error getting journal for service %s: %s\n", ser, err.Error())
 			fmt.Printf("Output from command: %s\n", out)
 		}
-		machineGatherLog(m, fmt.Sprintf("/run/%s.log", ser))
+		machineGatherLog(m, logPath)
 	}
+}
+
+func machineGatherAllLogs(m types.Machine, services []string, logFiles []string) {
+	// services
+	machineGatherServiceLogs(m, services, 0)
 
 	// log files
 	for _, file := range logFiles {
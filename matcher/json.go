@@ -0,0 +1,46 @@
+package matcher
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/spectrocloud/peg/pkg/controller"
+	"github.com/spectrocloud/peg/pkg/machine/types"
+)
+
+// CommandJSON runs cmd and unmarshals its standard output into out. It fails if
+// the command exits with a non-zero code or doesn't print valid JSON.
+func (vm VM) CommandJSON(cmd string, out interface{}) error {
+	return machineCommandJSON(vm.target(), cmd, out)
+}
+
+func CommandJSON(cmd string, out interface{}) error {
+	return machineCommandJSON(Machine, cmd, out)
+}
+
+func machineCommandJSON(m types.Machine, cmd string, out interface{}) error {
+	client, session, err := controller.NewClient(m)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	defer session.Close()
+
+	// stderr is kept apart, so that warnings don't break the JSON
+	var stdout, stderr bytes.Buffer
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+	err = runWithTimeout(m, client, cmd, func() error {
+		return session.Run(controller.WrapCommand(m, cmd))
+	})
+	if err != nil {
+		return fmt.Errorf("running %q: %w - %s", cmd, err, strings.TrimSpace(stderr.String()))
+	}
+
+	if err := json.Unmarshal(stdout.Bytes(), out); err != nil {
+		return fmt.Errorf("parsing output of %q: %w - %s", cmd, err, stdout.String())
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package matcher
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/spectrocloud/peg/pkg/machine/types"
+
+	. "github.com/onsi/gomega" //nolint:revive
+)
+
+// kernelVersionPrefix matches the numeric part of a kernel release, e.g. 6.1.0 in 6.1.0-17-amd64.
+var kernelVersionPrefix = regexp.MustCompile(`^[0-9]+(\.[0-9]+)*`)
+
+// KernelVersion returns the release of the running kernel, as printed by uname -r.
+func (vm VM) KernelVersion() (string, error) {
+	return machineKernelVersion(vm.target())
+}
+
+// ExpectKernelVersion asserts that the running kernel is v, which can be a
+// full release like 6.1.0-17-amd64 or a version prefix like 6.1.
+func (vm VM) ExpectKernelVersion(v string) {
+	machineExpectKernelVersion(vm.target(), v)
+}
+
+// ExpectKernelAtLeast asserts that the version of the running kernel,
+// ignoring distro suffixes, is at least v, e.g. 5.15.
+func (vm VM) ExpectKernelAtLeast(v string) {
+	machineExpectKernelAtLeast(vm.target(), v)
+}
+
+func KernelVersion() (string, error) {
+	return machineKernelVersion(Machine)
+}
+
+func ExpectKernelVersion(v string) {
+	machineExpectKernelVersion(Machine, v)
+}
+
+func ExpectKernelAtLeast(v string) {
+	machineExpectKernelAtLeast(Machine, v)
+}
+
+// parseKernelVersion returns the numeric components of the kernel release r.
+func parseKernelVersion(r string) ([]int, error) {
+	prefix := kernelVersionPrefix.FindString(strings.TrimSpace(r))
+	if prefix == "" {
+		return nil, fmt.Errorf("invalid kernel version %q", r)
+	}
+	var version []int
+	for _, c := range strings.Split(prefix, ".") {
+		n, err := strconv.Atoi(c)
+		if err != nil {
+			return nil, fmt.Errorf("invalid kernel version %q", r)
+		}
+		version = append(version, n)
+	}
+	return version, nil
+}
+
+// compareKernelVersions returns -1, 0 or 1 if a is older, the same or newer
+// than b. Missing components count as 0.
+func compareKernelVersions(a, b []int) int {
+	for i := 0; i < max(len(a), len(b)); i++ {
+		var x, y int
+		if i < len(a) {
+			x = a[i]
+		}
+		if i < len(b) {
+			y = b[i]
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+func machineKernelVersion(m types.Machine) (string, error) {
+	out, err := m.Command("uname -r")
+	if err != nil {
+		return "", fmt.Errorf("running uname: %w - %s", err, out)
+	}
+	return strings.TrimSpace(out), nil
+}
+
+func machineExpectKernelVersion(m types.Machine, v string) {
+	release, err := machineKernelVersion(m)
+	ExpectWithOffset(2, err).ToNot(HaveOccurred())
+
+	// A prefix has to end at a component boundary, so that 6.1 doesn't match 6.10
+	matches := release == v || (strings.HasPrefix(release, v) && strings.ContainsAny(release[len(v):len(v)+1], ".-+_"))
+	ExpectWithOffset(2, matches).To(BeTrue(), fmt.Sprintf("running kernel %s is not %s", release, v))
+}
+
+func machineExpectKernelAtLeast(m types.Machine, v string) {
+	want, err := parseKernelVersion(v)
+	ExpectWithOffset(2, err).ToNot(HaveOccurred())
+
+	release, err := machineKernelVersion(m)
+	ExpectWithOffset(2, err).ToNot(HaveOccurred())
+	got, err := parseKernelVersion(release)
+	ExpectWithOffset(2, err).ToNot(HaveOccurred())
+
+	ExpectWithOffset(2, compareKernelVersions(got, want)).To(BeNumerically(">=", 0), fmt.Sprintf("running kernel %s is older than %s", release, v))
+}
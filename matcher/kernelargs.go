@@ -0,0 +1,59 @@
+package matcher
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/spectrocloud/peg/pkg/machine/types"
+
+	. "github.com/onsi/gomega" //nolint:revive
+)
+
+// KernelArgsFile is where RebootWithKernelArgs writes the extra kernel
+// arguments for the next boot, as a grub script setting $peg_cmdline.
+//
+// The guest has to cooperate: its grub.cfg must source the file, when
+// present, and append $peg_cmdline to the linux line, e.g.
+//
+//	if [ -f /peg-cmdline.cfg ]; then source /peg-cmdline.cfg; fi
+//	linux /vmlinuz root=... $peg_cmdline
+//
+// with /boot being the root of the grub partition.
+var KernelArgsFile = "/boot/peg-cmdline.cfg"
+
+// RebootWithKernelArgs reboots the machine once with args appended to the
+// kernel command line, see KernelArgsFile for the guest requirements, waits
+// until it's reachable again and checks that /proc/cmdline contains args.
+// The timeout in seconds defaults to 750.
+func (vm VM) RebootWithKernelArgs(args string, t ...int) {
+	machineRebootWithKernelArgs(vm.target(), args, t...)
+}
+
+func RebootWithKernelArgs(args string, t ...int) {
+	machineRebootWithKernelArgs(Machine, args, t...)
+}
+
+func machineRebootWithKernelArgs(m types.Machine, args string, t ...int) {
+	// grub quoting is like the shell one
+	script := fmt.Sprintf("set peg_cmdline=%s\n", shellQuote(args))
+	out, err := machineSudo(m, fmt.Sprintf("printf '%%s' %s > %s", shellQuote(script), shellQuote(KernelArgsFile)))
+	ExpectWithOffset(2, err).ToNot(HaveOccurred(), out)
+
+	timeout := 750
+	if len(t) != 0 {
+		timeout = t[0]
+	}
+	err = machineWaitForReboot(m, func() {
+		machineSudo(m, "reboot") //nolint:errcheck
+	}, time.Duration(timeout)*time.Second)
+	ExpectWithOffset(2, err).ToNot(HaveOccurred())
+
+	// The arguments only apply to this boot
+	out, err = machineSudo(m, fmt.Sprintf("rm -f %s", shellQuote(KernelArgsFile)))
+	ExpectWithOffset(2, err).ToNot(HaveOccurred(), out)
+
+	cmdline, err := m.Command("cat /proc/cmdline")
+	ExpectWithOffset(2, err).ToNot(HaveOccurred(), cmdline)
+	ExpectWithOffset(2, strings.TrimSpace(cmdline)).To(ContainSubstring(args), "the bootloader did not apply the kernel arguments, see KernelArgsFile")
+}
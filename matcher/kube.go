@@ -0,0 +1,68 @@
+package matcher
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spectrocloud/peg/pkg/machine/types"
+)
+
+// kubeLogsScript writes the logs of each container of the pods in $ns to
+// /run, and prints the file names. It uses kubectl with the kubeconfig of the
+// distro, or crictl when there is no kubectl or kubeconfig.
+const kubeLogsScript = `kc="$KUBECONFIG"
+for f in /etc/rancher/k3s/k3s.yaml /etc/rancher/rke2/rke2.yaml /etc/kubernetes/admin.conf /root/.kube/config; do
+	[ -z "$kc" ] && [ -f "$f" ] && kc="$f"
+done
+if command -v kubectl >/dev/null 2>&1; then k=kubectl
+elif command -v k3s >/dev/null 2>&1; then k="k3s kubectl"
+elif [ -x /var/lib/rancher/rke2/bin/kubectl ]; then k=/var/lib/rancher/rke2/bin/kubectl
+fi
+if command -v crictl >/dev/null 2>&1; then c=crictl
+elif command -v k3s >/dev/null 2>&1; then c="k3s crictl"
+fi
+
+if [ -n "$k" ] && [ -n "$kc" ]; then
+	export KUBECONFIG="$kc"
+	for pod in $($k get pods -n "$ns" -o jsonpath='{.items[*].metadata.name}'); do
+		for ctr in $($k get pod "$pod" -n "$ns" -o jsonpath='{.spec.initContainers[*].name} {.spec.containers[*].name}'); do
+			f="/run/kube-$ns-$pod-$ctr.log"
+			$k logs -n "$ns" "$pod" -c "$ctr" > "$f" 2>&1
+			echo "$f"
+		done
+	done
+elif [ -n "$c" ]; then
+	for id in $($c ps -a -q --label "io.kubernetes.pod.namespace=$ns"); do
+		f="/run/kube-$ns-$id.log"
+		$c logs "$id" > "$f" 2>&1
+		echo "$f"
+	done
+else
+	echo "neither kubectl with a kubeconfig nor crictl found" >&2
+	exit 1
+fi`
+
+// GatherKubeLogs gathers the logs of the containers of the pods in namespace,
+// like GatherLog does for files, using kubectl or crictl.
+func (vm VM) GatherKubeLogs(namespace string) {
+	machineGatherKubeLogs(vm.target(), namespace)
+}
+
+func GatherKubeLogs(namespace string) {
+	machineGatherKubeLogs(Machine, namespace)
+}
+
+func machineGatherKubeLogs(m types.Machine, namespace string) {
+	out, err := machineSudo(m, fmt.Sprintf("ns=%s\n%s", shellQuote(namespace), kubeLogsScript))
+	if err != nil {
+		fmt.Printf("Error getting logs of namespace %s: %s\n", namespace, err.Error())
+		fmt.Printf("Output from command: %s\n", out)
+		return
+	}
+
+	for _, f := range strings.Split(out, "\n") {
+		if f = strings.TrimSpace(f); strings.HasPrefix(f, "/run/kube-") {
+			machineGatherLog(m, f)
+		}
+	}
+}
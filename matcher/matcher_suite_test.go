@@ -0,0 +1,12 @@
+package matcher_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"testing"
+)
+
+func TestMatcher(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Matcher Suite")
+}
@@ -0,0 +1,65 @@
+package matcher
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/spectrocloud/peg/pkg/machine/types"
+
+	. "github.com/onsi/gomega" //nolint:revive
+)
+
+// moduleName matches valid kernel module names, once dashes are replaced.
+var moduleName = regexp.MustCompile(`^[a-zA-Z0-9_]+$`)
+
+// ModuleLoaded returns whether the kernel module name is loaded or built into the kernel.
+func (vm VM) ModuleLoaded(name string) bool {
+	return machineModuleLoaded(vm.target(), name)
+}
+
+// ExpectModule asserts that the kernel module name is loaded or built into the kernel.
+func (vm VM) ExpectModule(name string) {
+	machineExpectModule(vm.target(), name)
+}
+
+// LoadModule loads the kernel module name with modprobe.
+func (vm VM) LoadModule(name string) error {
+	return machineLoadModule(vm.target(), name)
+}
+
+func ModuleLoaded(name string) bool {
+	return machineModuleLoaded(Machine, name)
+}
+
+func ExpectModule(name string) {
+	machineExpectModule(Machine, name)
+}
+
+func LoadModule(name string) error {
+	return machineLoadModule(Machine, name)
+}
+
+func machineModuleLoaded(m types.Machine, name string) bool {
+	// The kernel lists modules with underscores, even if named with dashes
+	name = strings.ReplaceAll(name, "-", "_")
+	if !moduleName.MatchString(name) {
+		return false
+	}
+	// Built-in modules are not in /proc/modules, but show up in /sys/module
+	script := `if awk -v m="$1" '$1 == m { f = 1 } END { exit !f }' /proc/modules 2>/dev/null || [ -d "/sys/module/$1" ]; then echo ok; fi`
+	out, err := m.Command(fmt.Sprintf("sh -c %s _ %s", shellQuote(script), shellQuote(name)))
+	return err == nil && strings.TrimSpace(out) == "ok"
+}
+
+func machineExpectModule(m types.Machine, name string) {
+	ExpectWithOffset(2, machineModuleLoaded(m, name)).To(BeTrue(), "kernel module %s is not loaded", name)
+}
+
+func machineLoadModule(m types.Machine, name string) error {
+	out, err := machineSudo(m, fmt.Sprintf("modprobe %s", shellQuote(name)))
+	if err != nil {
+		return fmt.Errorf("loading module %s: %w - %s", name, err, out)
+	}
+	return nil
+}
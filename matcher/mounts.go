@@ -0,0 +1,150 @@
+package matcher
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/spectrocloud/peg/pkg/machine/types"
+)
+
+// Mount is an entry of the mount table of the machine.
+type Mount struct {
+	Source     string
+	MountPoint string
+	FSType     string
+	Options    []string
+}
+
+// Mounts returns the mount table of the machine, as listed in /proc/self/mounts.
+func (vm VM) Mounts() ([]Mount, error) {
+	return machineMounts(vm.target())
+}
+
+// IsMounted returns whether a filesystem is mounted at mountpoint.
+func (vm VM) IsMounted(mountpoint string) (bool, error) {
+	return machineIsMounted(vm.target(), mountpoint)
+}
+
+// MountType returns the filesystem type mounted at mountpoint.
+func (vm VM) MountType(mountpoint string) (string, error) {
+	return machineMountType(vm.target(), mountpoint)
+}
+
+// HasMountWithOption returns whether the filesystem at mountpoint is mounted
+// with option (e.g. "ro" or "noexec").
+func (vm VM) HasMountWithOption(mountpoint, option string) (bool, error) {
+	return machineHasMountWithOption(vm.target(), mountpoint, option)
+}
+
+func Mounts() ([]Mount, error) {
+	return machineMounts(Machine)
+}
+
+func IsMounted(mountpoint string) (bool, error) {
+	return machineIsMounted(Machine, mountpoint)
+}
+
+func MountType(mountpoint string) (string, error) {
+	return machineMountType(Machine, mountpoint)
+}
+
+func HasMountWithOption(mountpoint, option string) (bool, error) {
+	return machineHasMountWithOption(Machine, mountpoint, option)
+}
+
+func machineMounts(m types.Machine) ([]Mount, error) {
+	out, err := m.Command("cat /proc/self/mounts")
+	if err != nil {
+		return nil, fmt.Errorf("reading mounts: %w - %s", err, out)
+	}
+	return parseMounts(out), nil
+}
+
+// parseMounts parses the content of /proc/mounts.
+func parseMounts(s string) []Mount {
+	var mounts []Mount
+	for _, line := range strings.Split(s, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 {
+			continue
+		}
+		mounts = append(mounts, Mount{
+			Source:     unescapeMountField(fields[0]),
+			MountPoint: unescapeMountField(fields[1]),
+			FSType:     fields[2],
+			Options:    strings.Split(fields[3], ","),
+		})
+	}
+	return mounts
+}
+
+// unescapeMountField decodes the octal escapes (e.g. \040 for spaces) used in /proc/mounts.
+func unescapeMountField(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// findMount returns the mount at mountpoint. When several filesystems are
+// mounted on the same path, the last one is the visible one.
+func findMount(m types.Machine, mountpoint string) (*Mount, error) {
+	mounts, err := machineMounts(m)
+	if err != nil {
+		return nil, err
+	}
+	mountpoint = strings.TrimSuffix(mountpoint, "/")
+	if mountpoint == "" {
+		mountpoint = "/"
+	}
+	for i := len(mounts) - 1; i >= 0; i-- {
+		if mounts[i].MountPoint == mountpoint {
+			return &mounts[i], nil
+		}
+	}
+	return nil, nil
+}
+
+func machineIsMounted(m types.Machine, mountpoint string) (bool, error) {
+	mount, err := findMount(m, mountpoint)
+	return mount != nil, err
+}
+
+func machineMountType(m types.Machine, mountpoint string) (string, error) {
+	mount, err := findMount(m, mountpoint)
+	if err != nil {
+		return "", err
+	}
+	if mount == nil {
+		return "", fmt.Errorf("nothing mounted at %s", mountpoint)
+	}
+	return mount.FSType, nil
+}
+
+func machineHasMountWithOption(m types.Machine, mountpoint, option string) (bool, error) {
+	mount, err := findMount(m, mountpoint)
+	if err != nil {
+		return false, err
+	}
+	if mount == nil {
+		return false, fmt.Errorf("nothing mounted at %s", mountpoint)
+	}
+	for _, o := range mount.Options {
+		if o == option {
+			return true, nil
+		}
+	}
+	return false, nil
+}
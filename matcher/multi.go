@@ -0,0 +1,49 @@
+package matcher
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// MaxParallelCommands bounds how many machines RunOnAll runs commands on at once.
+var MaxParallelCommands = 10
+
+// RunOnAll runs cmd on every VM concurrently and returns the output of each one,
+// keyed by machine ID. Errors from all the machines are aggregated.
+func RunOnAll(vms []VM, cmd string) (map[string]string, error) {
+	var (
+		lock sync.Mutex
+		wg   sync.WaitGroup
+		errs []error
+	)
+	outs := map[string]string{}
+
+	parallel := MaxParallelCommands
+	if parallel <= 0 {
+		parallel = len(vms)
+	}
+	sem := make(chan struct{}, parallel)
+
+	for _, vm := range vms {
+		wg.Add(1)
+		go func(vm VM) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			id := vm.machine.Config().ID
+			out, err := vm.target().Command(cmd)
+
+			lock.Lock()
+			defer lock.Unlock()
+			outs[id] = out
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", id, err))
+			}
+		}(vm)
+	}
+	wg.Wait()
+
+	return outs, errors.Join(errs...)
+}
@@ -0,0 +1,59 @@
+package matcher
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/spectrocloud/peg/pkg/machine/types"
+
+	. "github.com/onsi/gomega" //nolint:revive
+)
+
+// ErrNoPackageManager is returned when the machine has none of the supported package managers.
+var ErrNoPackageManager = errors.New("no supported package manager (rpm, dpkg) found")
+
+// PackageInstalled returns whether the package name is installed, using rpm or dpkg.
+func (vm VM) PackageInstalled(name string) (bool, error) {
+	return machinePackageInstalled(vm.target(), name)
+}
+
+// ExpectPackage asserts that the package name is installed.
+func (vm VM) ExpectPackage(name string) {
+	machineExpectPackage(vm.target(), name)
+}
+
+func PackageInstalled(name string) (bool, error) {
+	return machinePackageInstalled(Machine, name)
+}
+
+func ExpectPackage(name string) {
+	machineExpectPackage(Machine, name)
+}
+
+func machinePackageInstalled(m types.Machine, name string) (bool, error) {
+	out, err := m.Command("if command -v rpm >/dev/null 2>&1; then echo rpm; elif command -v dpkg-query >/dev/null 2>&1; then echo dpkg; fi")
+	if err != nil {
+		return false, fmt.Errorf("detecting the package manager: %w - %s", err, out)
+	}
+
+	var query string
+	switch strings.TrimSpace(out) {
+	case "rpm":
+		query = fmt.Sprintf("rpm -q %s", shellQuote(name))
+	case "dpkg":
+		// dpkg knows about removed packages too, only count the installed ones
+		query = fmt.Sprintf("dpkg-query -W -f '${Status}' %s 2>/dev/null | grep -q 'install ok installed'", shellQuote(name))
+	default:
+		return false, ErrNoPackageManager
+	}
+
+	_, err = m.Command(query)
+	return err == nil, nil
+}
+
+func machineExpectPackage(m types.Machine, name string) {
+	installed, err := machinePackageInstalled(m, name)
+	ExpectWithOffset(2, err).ToNot(HaveOccurred())
+	ExpectWithOffset(2, installed).To(BeTrue(), "package %s is not installed", name)
+}
@@ -0,0 +1,46 @@
+package matcher
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/spectrocloud/peg/pkg/machine/types"
+
+	. "github.com/onsi/gomega" //nolint:revive
+)
+
+// PortListening returns whether a TCP socket listens on port in the machine.
+func (vm VM) PortListening(port int) bool {
+	return machinePortListening(vm.target(), port)
+}
+
+// EventuallyPortListening waits until a TCP socket listens on port in the
+// machine. The timeout in seconds defaults to 120.
+func (vm VM) EventuallyPortListening(port int, t ...int) {
+	machineEventuallyPortListening(vm.target(), port, t...)
+}
+
+func PortListening(port int) bool {
+	return machinePortListening(Machine, port)
+}
+
+func EventuallyPortListening(port int, t ...int) {
+	machineEventuallyPortListening(Machine, port, t...)
+}
+
+func machinePortListening(m types.Machine, port int) bool {
+	// Without ss, look for sockets in the LISTEN (0A) state in /proc
+	_, err := machineSudo(m, fmt.Sprintf(`if command -v ss >/dev/null 2>&1; then ss -Hltn 'sport = :%[1]d' | grep -q .; `+
+		`else cat /proc/net/tcp /proc/net/tcp6 2>/dev/null | awk '$4 == "0A" { split($2, a, ":"); if (a[2] == "%04[1]X") found = 1 } END { exit !found }'; fi`, port))
+	return err == nil
+}
+
+func machineEventuallyPortListening(m types.Machine, port int, t ...int) {
+	timeout := 120
+	if len(t) > 0 {
+		timeout = t[0]
+	}
+	EventuallyWithOffset(2, func() bool {
+		return machinePortListening(m, port)
+	}, time.Duration(timeout)*time.Second, 2*time.Second).Should(BeTrue(), fmt.Sprintf("nothing listening on port %d", port))
+}
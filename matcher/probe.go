@@ -0,0 +1,81 @@
+package matcher
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/spectrocloud/peg/pkg/machine/types"
+
+	. "github.com/onsi/gomega" //nolint:revive
+)
+
+// Probe checks whether a service of a machine is ready.
+type Probe interface {
+	Ready(m types.Machine) error
+}
+
+// ProbeFunc adapts a function to the Probe interface.
+type ProbeFunc func(m types.Machine) error
+
+func (f ProbeFunc) Ready(m types.Machine) error {
+	return f(m)
+}
+
+// TCPProbe is ready when a TCP connection can be established to the given port on the host.
+// Use it against ports forwarded from the guest to the host.
+func TCPProbe(port int) Probe {
+	return ProbeFunc(func(_ types.Machine) error {
+		conn, err := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", port), 5*time.Second)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	})
+}
+
+// HTTPProbe is ready when a GET against url, issued from the host, returns expectStatus.
+func HTTPProbe(url string, expectStatus int) Probe {
+	return ProbeFunc(func(_ types.Machine) error {
+		client := &http.Client{Timeout: 5 * time.Second}
+		resp, err := client.Get(url)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != expectStatus {
+			return fmt.Errorf("unexpected status code from %s: got %d, expected %d", url, resp.StatusCode, expectStatus)
+		}
+		return nil
+	})
+}
+
+// CommandProbe is ready when cmd runs successfully inside the machine.
+func CommandProbe(cmd string) Probe {
+	return ProbeFunc(func(m types.Machine) error {
+		out, err := m.Command(cmd)
+		if err != nil {
+			return fmt.Errorf("%w: %s", err, out)
+		}
+		return nil
+	})
+}
+
+func (vm VM) EventuallyReady(p Probe, t ...int) {
+	machineEventuallyReady(vm.target(), p, t...)
+}
+
+func EventuallyReady(p Probe, t ...int) {
+	machineEventuallyReady(Machine, p, t...)
+}
+
+func machineEventuallyReady(m types.Machine, p Probe, t ...int) {
+	dur := 360
+	if len(t) > 0 {
+		dur = t[0]
+	}
+	Eventually(func() error {
+		return p.Ready(m)
+	}, time.Duration(dur)*time.Second, 5*time.Second).Should(Succeed(), "Machine did not become ready in time")
+}
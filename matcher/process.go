@@ -0,0 +1,98 @@
+package matcher
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/spectrocloud/peg/pkg/machine/types"
+
+	. "github.com/onsi/gomega" //nolint:revive
+)
+
+// ProcessCount returns how many processes called exactly name run in the
+// machine, as matched by `pgrep -x`, leaving out the shell running the check
+// and its sudo. The kernel truncates process names to 15 characters.
+func (vm VM) ProcessCount(name string) (int, error) {
+	return machineProcessCount(vm.target(), name)
+}
+
+// ProcessRunning returns whether a process called exactly name runs in the machine.
+func (vm VM) ProcessRunning(name string) bool {
+	return machineProcessRunning(vm.target(), name)
+}
+
+// ExpectProcess asserts that a process called exactly name runs in the machine.
+func (vm VM) ExpectProcess(name string) {
+	machineExpectProcess(vm.target(), name)
+}
+
+// ExpectNoProcess asserts that no process called exactly name runs in the machine.
+func (vm VM) ExpectNoProcess(name string) {
+	machineExpectNoProcess(vm.target(), name)
+}
+
+func ProcessCount(name string) (int, error) {
+	return machineProcessCount(Machine, name)
+}
+
+func ProcessRunning(name string) bool {
+	return machineProcessRunning(Machine, name)
+}
+
+func ExpectProcess(name string) {
+	machineExpectProcess(Machine, name)
+}
+
+func ExpectNoProcess(name string) {
+	machineExpectNoProcess(Machine, name)
+}
+
+// processCountScript counts the processes matched by `pgrep -x "$1"`, except
+// the ones running the script itself: the shell and its ancestors up to the
+// SSH session, e.g. sudo and the login shell. pgrep runs straight from the
+// shell, a subshell would be counted when looking for sh.
+const processCountScript = `pids=$(mktemp) || exit 1
+pgrep -x "$1" > "$pids"
+if [ $? -gt 1 ]; then rm -f "$pids"; exit 1; fi
+self=" "
+p=$$
+while [ "$p" -gt 1 ] && [ "$(cat /proc/$p/comm)" != sshd ]; do
+	self="$self$p "
+	p=$(awk '/^PPid:/ {print $2}' /proc/$p/status)
+done
+n=0
+while read -r pid; do
+	case "$self" in *" $pid "*) ;; *) n=$((n+1)) ;; esac
+done < "$pids"
+rm -f "$pids"
+echo "$n"`
+
+func machineProcessCount(m types.Machine, name string) (int, error) {
+	out, err := machineSudo(m, fmt.Sprintf("sh -c %s _ %s", shellQuote(processCountScript), shellQuote(name)))
+	if err != nil {
+		return 0, fmt.Errorf("looking for process %s: %w - %s", name, err, out)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(out))
+	if err != nil {
+		return 0, fmt.Errorf("unexpected pgrep output for process %s: %q", name, out)
+	}
+	return n, nil
+}
+
+func machineProcessRunning(m types.Machine, name string) bool {
+	n, err := machineProcessCount(m, name)
+	return err == nil && n > 0
+}
+
+func machineExpectProcess(m types.Machine, name string) {
+	n, err := machineProcessCount(m, name)
+	ExpectWithOffset(2, err).ToNot(HaveOccurred())
+	ExpectWithOffset(2, n).To(BeNumerically(">", 0), "process %s is not running", name)
+}
+
+func machineExpectNoProcess(m types.Machine, name string) {
+	n, err := machineProcessCount(m, name)
+	ExpectWithOffset(2, err).ToNot(HaveOccurred())
+	ExpectWithOffset(2, n).To(BeZero(), "process %s is running", name)
+}
@@ -0,0 +1,39 @@
+package matcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// restarter is implemented by machines able to restart their process while
+// keeping their disks.
+type restarter interface {
+	ColdRestart(ctx context.Context) (context.Context, error)
+}
+
+// Restart does a cold restart of the machine, as opposed to a reboot of the
+// guest: it stops the machine, waits for its process to exit, creates it
+// again with the same config and state dir and waits for it to be reachable.
+// The returned context is like the one returned by Start.
+func (vm *VM) Restart(ctx context.Context) (context.Context, error) {
+	r, ok := engine(vm.machine).(restarter)
+	if !ok {
+		return ctx, errors.New("restart is not supported by this engine")
+	}
+
+	// Stop monitoring the old process before it is killed
+	if vm.cancelFunc != nil {
+		vm.cancelFunc()
+	}
+	var newCtx context.Context
+	newCtx, vm.cancelFunc = context.WithCancel(ctx)
+
+	newCtx, err := r.ColdRestart(newCtx)
+	if err != nil {
+		return newCtx, fmt.Errorf("restarting the machine: %w", err)
+	}
+
+	vm.EventuallyConnects()
+	return newCtx, nil
+}
@@ -0,0 +1,60 @@
+package matcher
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/spectrocloud/peg/pkg/machine/types"
+
+	. "github.com/onsi/gomega" //nolint:revive
+)
+
+// ErrNoDefaultRoute is returned by DefaultRoute when the machine has no default route.
+var ErrNoDefaultRoute = errors.New("no default route")
+
+// DefaultRoute returns the gateway and interface of the IPv4 default route of
+// the machine. With several default routes, the one with the lowest metric is used.
+func (vm VM) DefaultRoute() (gateway, iface string, err error) {
+	return machineDefaultRoute(vm.target())
+}
+
+// ExpectDefaultRouteVia asserts that the default route of the machine goes through gateway.
+func (vm VM) ExpectDefaultRouteVia(gateway string) {
+	machineExpectDefaultRouteVia(vm.target(), gateway)
+}
+
+func DefaultRoute() (gateway, iface string, err error) {
+	return machineDefaultRoute(Machine)
+}
+
+func ExpectDefaultRouteVia(gateway string) {
+	machineExpectDefaultRouteVia(Machine, gateway)
+}
+
+func machineDefaultRoute(m types.Machine) (gateway, iface string, err error) {
+	var routes []struct {
+		Gateway string `json:"gateway"`
+		Dev     string `json:"dev"`
+		Metric  int    `json:"metric"`
+	}
+	if err := machineCommandJSON(m, "ip -j route show default", &routes); err != nil {
+		return "", "", err
+	}
+	if len(routes) == 0 {
+		return "", "", ErrNoDefaultRoute
+	}
+
+	best := routes[0]
+	for _, r := range routes[1:] {
+		if r.Metric < best.Metric {
+			best = r
+		}
+	}
+	return best.Gateway, best.Dev, nil
+}
+
+func machineExpectDefaultRouteVia(m types.Machine, gateway string) {
+	got, iface, err := machineDefaultRoute(m)
+	ExpectWithOffset(2, err).ToNot(HaveOccurred())
+	ExpectWithOffset(2, got).To(Equal(gateway), fmt.Sprintf("default route is via %s dev %s", got, iface))
+}
@@ -0,0 +1,74 @@
+package matcher
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spectrocloud/peg/pkg/machine/types"
+)
+
+// RunScript uploads the script at localPath, runs it as root with args and
+// removes it afterwards. It returns the output of the script.
+func (vm VM) RunScript(localPath string, args ...string) (string, error) {
+	return machineRunScript(vm.target(), localPath, args...)
+}
+
+// RunScriptString is like RunScript, but takes the content of the script.
+func (vm VM) RunScriptString(script string, args ...string) (string, error) {
+	return machineRunScriptString(vm.target(), script, args...)
+}
+
+func RunScript(localPath string, args ...string) (string, error) {
+	return machineRunScript(Machine, localPath, args...)
+}
+
+func RunScriptString(script string, args ...string) (string, error) {
+	return machineRunScriptString(Machine, script, args...)
+}
+
+// shellQuote quotes s to be passed as a single argument to sh.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func machineRunScript(m types.Machine, localPath string, args ...string) (string, error) {
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+	remotePath := "/tmp/peg-script-" + hex.EncodeToString(suffix)
+	if err := m.SendFile(localPath, remotePath, "0755"); err != nil {
+		return "", fmt.Errorf("uploading script %s: %w", localPath, err)
+	}
+	defer func() {
+		_, _ = machineSudo(m, "rm -f "+remotePath)
+	}()
+
+	cmd := []string{remotePath}
+	for _, a := range args {
+		cmd = append(cmd, shellQuote(a))
+	}
+
+	return machineSudo(m, strings.Join(cmd, " "))
+}
+
+func machineRunScriptString(m types.Machine, script string, args ...string) (string, error) {
+	f, err := os.CreateTemp(tempDir(m), "peg-script-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.WriteString(script); err != nil {
+		f.Close()
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+
+	return machineRunScript(m, f.Name(), args...)
+}
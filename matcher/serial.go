@@ -0,0 +1,32 @@
+package matcher
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/spectrocloud/peg/pkg/machine/types"
+)
+
+// serialWaiter is implemented by machines capturing their serial console.
+type serialWaiter interface {
+	WaitForSerialLine(pattern string, timeout time.Duration) error
+}
+
+// WaitForSerialLine waits until a line of the serial console of the machine
+// matches the regular expression pattern, e.g. "Reached target.*Multi-User".
+// It is only supported by qemu machines.
+func (vm VM) WaitForSerialLine(pattern string, timeout time.Duration) error {
+	return machineWaitForSerialLine(vm.target(), pattern, timeout)
+}
+
+func WaitForSerialLine(pattern string, timeout time.Duration) error {
+	return machineWaitForSerialLine(Machine, pattern, timeout)
+}
+
+func machineWaitForSerialLine(m types.Machine, pattern string, timeout time.Duration) error {
+	s, ok := engine(m).(serialWaiter)
+	if !ok {
+		return fmt.Errorf("the serial console is not supported by the %s engine", m.Config().Engine)
+	}
+	return s.WaitForSerialLine(pattern, timeout)
+}
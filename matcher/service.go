@@ -0,0 +1,56 @@
+package matcher
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/spectrocloud/peg/pkg/machine/types"
+)
+
+// ErrReloadNotSupported is returned by ReloadService for units that can't be reloaded.
+var ErrReloadNotSupported = errors.New("unit does not support reloading")
+
+// ReloadService asks the systemd unit to reload its configuration, without restarting it.
+func (vm VM) ReloadService(unit string) error {
+	return machineReloadService(vm.target(), unit)
+}
+
+// ServiceState returns the state of the systemd unit, e.g. "active" or "failed".
+func (vm VM) ServiceState(unit string) (string, error) {
+	return machineServiceState(vm.target(), unit)
+}
+
+func ReloadService(unit string) error {
+	return machineReloadService(Machine, unit)
+}
+
+func ServiceState(unit string) (string, error) {
+	return machineServiceState(Machine, unit)
+}
+
+func machineReloadService(m types.Machine, unit string) error {
+	out, err := machineSudo(m, fmt.Sprintf("systemctl show --property=CanReload --value %s", shellQuote(unit)))
+	if err != nil {
+		return fmt.Errorf("checking if %s can be reloaded: %w - %s", unit, err, out)
+	}
+	if strings.TrimSpace(out) != "yes" {
+		return fmt.Errorf("%s: %w", unit, ErrReloadNotSupported)
+	}
+
+	out, err = machineSudo(m, fmt.Sprintf("systemctl reload %s", shellQuote(unit)))
+	if err != nil {
+		return fmt.Errorf("reloading %s failed: %w - %s", unit, err, out)
+	}
+	return nil
+}
+
+func machineServiceState(m types.Machine, unit string) (string, error) {
+	// is-active exits with an error for any state but active, the state is printed anyway
+	out, _ := machineSudo(m, fmt.Sprintf("systemctl is-active %s", shellQuote(unit)))
+	state := strings.TrimSpace(out)
+	if state == "" || strings.Contains(state, "\n") {
+		return "", fmt.Errorf("getting the state of %s: %s", unit, out)
+	}
+	return state, nil
+}
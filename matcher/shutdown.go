@@ -0,0 +1,29 @@
+package matcher
+
+import (
+	"github.com/spectrocloud/peg/pkg/machine/types"
+
+	. "github.com/onsi/gomega" //nolint:revive
+)
+
+// cleanShutdownChecker is implemented by machines able to inspect their disk offline.
+type cleanShutdownChecker interface {
+	CheckCleanShutdown() error
+}
+
+// ExpectCleanShutdown asserts that the root filesystem of the machine was
+// cleanly unmounted. Call it once the machine shut down, e.g. after a poweroff
+// in the guest. It is only supported by qemu machines and needs root.
+func (vm VM) ExpectCleanShutdown() {
+	machineExpectCleanShutdown(vm.target())
+}
+
+func ExpectCleanShutdown() {
+	machineExpectCleanShutdown(Machine)
+}
+
+func machineExpectCleanShutdown(m types.Machine) {
+	c, ok := engine(m).(cleanShutdownChecker)
+	ExpectWithOffset(2, ok).To(BeTrue(), "checking the shutdown is not supported by the %s engine", m.Config().Engine)
+	ExpectWithOffset(2, c.CheckCleanShutdown()).To(Succeed())
+}
@@ -0,0 +1,111 @@
+package matcher
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/spectrocloud/peg/pkg/machine/types"
+
+	. "github.com/onsi/gomega" //nolint:revive
+)
+
+// StateSnapshot is the state of a machine at some point, e.g. before an upgrade.
+type StateSnapshot struct {
+	Kernel string
+	// Packages are "name version" entries
+	Packages []string
+	// Services are "unit active sub" entries
+	Services []string
+	// Mounts are "mountpoint fstype options" entries
+	Mounts []string
+}
+
+// CaptureState records the kernel, installed packages, services and mounts of the machine.
+func (vm VM) CaptureState() StateSnapshot {
+	return machineCaptureState(vm.target())
+}
+
+func CaptureState() StateSnapshot {
+	return machineCaptureState(Machine)
+}
+
+// sortedLines returns the non empty lines of s, sorted.
+func sortedLines(s string) []string {
+	lines := []string{}
+	for _, l := range strings.Split(s, "\n") {
+		if l = strings.TrimSpace(l); l != "" {
+			lines = append(lines, l)
+		}
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+func machineCaptureState(m types.Machine) StateSnapshot {
+	s := StateSnapshot{}
+
+	s.Kernel = machineSudoOut(m, "uname -r")
+
+	// Whichever package manager is available
+	s.Packages = sortedLines(machineSudoOut(m, `if command -v rpm >/dev/null 2>&1; then rpm -qa --qf '%{NAME} %{VERSION}-%{RELEASE}\n'; `+
+		`elif command -v dpkg-query >/dev/null 2>&1; then dpkg-query -W -f '${Package} ${Version}\n'; `+
+		`elif command -v apk >/dev/null 2>&1; then apk info -v; fi`))
+
+	s.Services = sortedLines(machineSudoOut(m, `if command -v systemctl >/dev/null 2>&1; then `+
+		`systemctl list-units --type=service --all --no-legend --plain | awk '{print $1, $3, $4}'; fi`))
+
+	mounts, err := machineMounts(m)
+	ExpectWithOffset(2, err).ToNot(HaveOccurred())
+	for _, mount := range mounts {
+		s.Mounts = append(s.Mounts, fmt.Sprintf("%s %s %s", mount.MountPoint, mount.FSType, strings.Join(mount.Options, ",")))
+	}
+	sort.Strings(s.Mounts)
+
+	return s
+}
+
+// Diff returns a human readable description of what changed from s to other,
+// empty if nothing did.
+func (s StateSnapshot) Diff(other StateSnapshot) string {
+	var b strings.Builder
+	if s.Kernel != other.Kernel {
+		fmt.Fprintf(&b, "kernel: %s -> %s\n", s.Kernel, other.Kernel)
+	}
+	diffSection(&b, "packages", s.Packages, other.Packages)
+	diffSection(&b, "services", s.Services, other.Services)
+	diffSection(&b, "mounts", s.Mounts, other.Mounts)
+	return b.String()
+}
+
+// diffSection writes the entries only in before with a "-" and the ones only in after with a "+".
+func diffSection(b *strings.Builder, name string, before, after []string) {
+	inBefore := map[string]bool{}
+	for _, e := range before {
+		inBefore[e] = true
+	}
+	inAfter := map[string]bool{}
+	for _, e := range after {
+		inAfter[e] = true
+	}
+
+	var lines []string
+	for _, e := range before {
+		if !inAfter[e] {
+			lines = append(lines, "- "+e)
+		}
+	}
+	for _, e := range after {
+		if !inBefore[e] {
+			lines = append(lines, "+ "+e)
+		}
+	}
+	if len(lines) == 0 {
+		return
+	}
+
+	fmt.Fprintf(b, "%s:\n", name)
+	for _, l := range lines {
+		fmt.Fprintf(b, "  %s\n", l)
+	}
+}
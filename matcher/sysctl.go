@@ -0,0 +1,70 @@
+package matcher
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spectrocloud/peg/pkg/machine/types"
+
+	. "github.com/onsi/gomega" //nolint:revive
+)
+
+// Sysctl returns the value of the kernel parameter key, e.g. "net.ipv4.ip_forward".
+func (vm VM) Sysctl(key string) (string, error) {
+	return machineSysctl(vm.target(), key)
+}
+
+// SetSysctl sets the kernel parameter key to value. The change is not persisted across reboots.
+func (vm VM) SetSysctl(key, value string) error {
+	return machineSetSysctl(vm.target(), key, value)
+}
+
+// ExpectSysctl asserts that the kernel parameter key is set to value.
+func (vm VM) ExpectSysctl(key, value string) {
+	machineExpectSysctl(vm.target(), key, value)
+}
+
+func Sysctl(key string) (string, error) {
+	return machineSysctl(Machine, key)
+}
+
+func SetSysctl(key, value string) error {
+	return machineSetSysctl(Machine, key, value)
+}
+
+func ExpectSysctl(key, value string) {
+	machineExpectSysctl(Machine, key, value)
+}
+
+// sysctlPath returns the /proc/sys path of key. Like sysctl(8), if the key
+// contains a slash it is used as separator, which allows dots in names (e.g.
+// "net/ipv4/conf/eth0.100/forwarding").
+func sysctlPath(key string) string {
+	if !strings.Contains(key, "/") {
+		key = strings.ReplaceAll(key, ".", "/")
+	}
+	return "/proc/sys/" + strings.TrimPrefix(key, "/")
+}
+
+func machineSysctl(m types.Machine, key string) (string, error) {
+	out, err := machineSudo(m, fmt.Sprintf("cat %s", shellQuote(sysctlPath(key))))
+	if err != nil {
+		return "", fmt.Errorf("reading sysctl %s: %w - %s", key, err, out)
+	}
+	// Multi value parameters are tab separated, normalize them like sysctl does
+	return strings.Join(strings.Fields(out), " "), nil
+}
+
+func machineSetSysctl(m types.Machine, key, value string) error {
+	out, err := machineSudo(m, fmt.Sprintf("echo %s > %s", shellQuote(value), shellQuote(sysctlPath(key))))
+	if err != nil {
+		return fmt.Errorf("setting sysctl %s to %s: %w - %s", key, value, err, out)
+	}
+	return nil
+}
+
+func machineExpectSysctl(m types.Machine, key, value string) {
+	out, err := machineSysctl(m, key)
+	ExpectWithOffset(2, err).ToNot(HaveOccurred())
+	ExpectWithOffset(2, out).To(Equal(strings.Join(strings.Fields(value), " ")), "sysctl %s", key)
+}
@@ -0,0 +1,87 @@
+package matcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/spectrocloud/peg/pkg/machine/types"
+	"golang.org/x/crypto/ssh"
+)
+
+// DefaultCommandTimeout is the CommandTimeout of the VMs returned by NewVM.
+// It is generous, to only catch commands which hang.
+const DefaultCommandTimeout = 30 * time.Minute
+
+// timeoutMachine runs the commands of the helpers of a VM with its CommandTimeout.
+type timeoutMachine struct {
+	types.Machine
+	timeout time.Duration
+}
+
+func (t timeoutMachine) Command(cmd string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), t.timeout)
+	defer cancel()
+	out, err := commandContext(ctx, t.Machine, cmd)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return out, fmt.Errorf("command timed out after %s: %s", t.timeout, cmd)
+	}
+	return out, err
+}
+
+// commandContext runs cmd on m, giving up when ctx is done. Machines which
+// can't cancel commands are left running cmd in the background.
+func commandContext(ctx context.Context, m types.Machine, cmd string) (string, error) {
+	if c, ok := m.(types.ContextCommander); ok {
+		return c.CommandContext(ctx, cmd)
+	}
+
+	type result struct {
+		out string
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		out, err := m.Command(cmd)
+		done <- result{out, err}
+	}()
+	select {
+	case r := <-done:
+		return r.out, r.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// target returns the machine the helpers of vm run on.
+func (vm VM) target() types.Machine {
+	if vm.CommandTimeout <= 0 {
+		return vm.machine
+	}
+	return timeoutMachine{Machine: vm.machine, timeout: vm.CommandTimeout}
+}
+
+// engine returns the machine behind m, to check the capabilities of its engine.
+func engine(m types.Machine) types.Machine {
+	if t, ok := m.(timeoutMachine); ok {
+		return t.Machine
+	}
+	return m
+}
+
+// runWithTimeout calls run, which uses client, and closes client if it takes
+// longer than the command timeout of m, if any.
+func runWithTimeout(m types.Machine, client *ssh.Client, cmd string, run func() error) error {
+	t, ok := m.(timeoutMachine)
+	if !ok {
+		return run()
+	}
+
+	timer := time.AfterFunc(t.timeout, func() { client.Close() })
+	err := run()
+	if !timer.Stop() {
+		return fmt.Errorf("command timed out after %s: %s", t.timeout, cmd)
+	}
+	return err
+}
@@ -1,12 +1,39 @@
 package controller
 
 import (
+	"errors"
 	"net"
 	"time"
 
 	"golang.org/x/crypto/ssh"
 )
 
+// ErrSSHTimeout is wrapped by the errors of SSHDialTimeout when the machine
+// doesn't answer in time, e.g. because it's still booting.
+var ErrSSHTimeout = errors.New("ssh connection timed out")
+
+// timeoutError tags a timeout with ErrSSHTimeout without changing its message.
+type timeoutError struct {
+	err error
+}
+
+func (e timeoutError) Error() string {
+	return e.err.Error()
+}
+
+func (e timeoutError) Unwrap() []error {
+	return []error{ErrSSHTimeout, e.err}
+}
+
+// withTimeout tags err with ErrSSHTimeout if it is a network timeout.
+func withTimeout(err error) error {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return timeoutError{err: err}
+	}
+	return err
+}
+
 type Conn struct {
 	net.Conn
 	ReadTimeout  time.Duration
@@ -33,13 +60,13 @@ func (c *Conn) Write(b []byte) (int, error) {
 func SSHDialTimeout(network, addr string, config *ssh.ClientConfig, timeout time.Duration) (*ssh.Client, error) {
 	conn, err := net.DialTimeout(network, addr, timeout)
 	if err != nil {
-		return nil, err
+		return nil, withTimeout(err)
 	}
 
 	timeoutConn := &Conn{conn, timeout, timeout}
 	c, chans, reqs, err := ssh.NewClientConn(timeoutConn, addr, config)
 	if err != nil {
-		return nil, err
+		return nil, withTimeout(err)
 	}
 	client := ssh.NewClient(c, chans, reqs)
 
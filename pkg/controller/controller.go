@@ -1,14 +1,20 @@
 package controller
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"net"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/bramvdbogaerde/go-scp"
 	"github.com/spectrocloud/peg/pkg/machine/types"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
 )
 
 // NewSCPClient returns a SCP client associated to the machine.
@@ -43,13 +49,56 @@ func sshConfig(m types.Machine) (*ssh.ClientConfig, string) {
 		Timeout: 30 * time.Second, // max time to establish connection
 	}
 
-	sshConfig.HostKeyCallback = ssh.InsecureIgnoreHostKey()
+	sshConfig.HostKeyCallback = hostKeyCallback(m.Config().SSH)
+	sshConfig.Ciphers = m.Config().SSH.Ciphers
+	sshConfig.KeyExchanges = m.Config().SSH.KeyExchanges
 
-	return sshConfig, fmt.Sprintf("127.0.0.1:%s", m.Config().SSH.Port)
+	host := m.Config().SSH.Host
+	if host == "" {
+		host = "127.0.0.1"
+	}
+
+	return sshConfig, net.JoinHostPort(host, m.Config().SSH.Port)
+}
+
+func hostKeyCallback(s *types.SSH) ssh.HostKeyCallback {
+	if s.HostKeyCallback != nil {
+		return s.HostKeyCallback
+	}
+	if !s.StrictHostKey {
+		return ssh.InsecureIgnoreHostKey()
+	}
+
+	knownHosts := s.KnownHosts
+	if knownHosts == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return failingHostKeyCallback(err)
+		}
+		knownHosts = filepath.Join(home, ".ssh", "known_hosts")
+	}
+
+	cb, err := knownhosts.New(knownHosts)
+	if err != nil {
+		return failingHostKeyCallback(fmt.Errorf("loading known hosts: %w", err))
+	}
+	return cb
+}
+
+// failingHostKeyCallback rejects every host key with err, so that
+// configuration errors surface when connecting.
+func failingHostKeyCallback(err error) ssh.HostKeyCallback {
+	return func(_ string, _ net.Addr, _ ssh.PublicKey) error {
+		return err
+	}
 }
 
+// ReceiveFile streams src from the machine into dst. Zeroed blocks are
+// not written, so sparse files stay sparse on the host.
 func ReceiveFile(m types.Machine, src, dst string) error {
 	scpClient := NewSCPClient(m)
+	// The timeout covers the whole transfer, which depends on the file size
+	scpClient.Timeout = 0
 
 	if err := scpClient.Connect(); err != nil {
 		return err
@@ -62,15 +111,19 @@ func ReceiveFile(m types.Machine, src, dst string) error {
 	}
 	defer f.Close()
 
-	err = scpClient.CopyFromRemote(context.Background(), f, src)
+	w := newSparseWriter(f)
+	err = scpClient.CopyFromRemotePassThru(context.Background(), w, src, nil)
 	if err != nil {
 		return err
 	}
-	return nil
+	return w.Close()
 }
 
+// SendFile streams src to dst in the machine without loading it in memory.
 func SendFile(m types.Machine, src, dst, permission string) error {
 	scpClient := NewSCPClient(m)
+	// The timeout covers the whole transfer, which depends on the file size
+	scpClient.Timeout = 0
 	defer scpClient.Close()
 
 	if err := scpClient.Connect(); err != nil {
@@ -85,20 +138,68 @@ func SendFile(m types.Machine, src, dst, permission string) error {
 	defer scpClient.Close()
 	defer f.Close()
 
-	return scpClient.CopyFile(context.Background(), f, dst, permission)
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	return scpClient.Copy(context.Background(), f, dst, permission, stat.Size())
+}
+
+// WrapCommand prefixes cmd with the CommandWrapper of the machine, if any.
+func WrapCommand(m types.Machine, cmd string) string {
+	wrapper := m.Config().CommandWrapper
+	if wrapper == "" {
+		return cmd
+	}
+	return wrapper + " '" + strings.ReplaceAll(cmd, "'", `'\''`) + "'"
 }
 
 func SSHCommand(m types.Machine, cmd string) (string, error) {
+	return SSHCommandContext(context.Background(), m, cmd)
+}
+
+// SSHCommandContext is like SSHCommand, closing the connection when ctx is
+// done, which returns ctx.Err() with the output gathered so far.
+func SSHCommandContext(ctx context.Context, m types.Machine, cmd string) (string, error) {
 	client, session, err := NewClient(m)
 	if err != nil {
 		return "", err
 	}
 
 	defer client.Close()
-	out, err := session.CombinedOutput(cmd)
-	if err != nil {
-		return string(out), err
+	var out syncBuffer
+	session.Stdout = &out
+	session.Stderr = &out
+
+	done := make(chan error, 1)
+	go func() {
+		done <- session.Run(WrapCommand(m, cmd))
+	}()
+
+	select {
+	case err = <-done:
+		return out.String(), err
+	case <-ctx.Done():
+		client.Close()
+		return out.String(), ctx.Err()
 	}
+}
+
+// syncBuffer is a bytes.Buffer safe to write from the ssh session while being read.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
 
-	return string(out), err
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
 }
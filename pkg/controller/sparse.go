@@ -0,0 +1,57 @@
+package controller
+
+import (
+	"io"
+	"os"
+)
+
+// sparseBlockSize is the granularity used to detect holes while writing.
+const sparseBlockSize = 4096
+
+// sparseWriter writes to a file skipping over blocks that are all zeroes,
+// so that holes of the source end up as holes in the destination file.
+type sparseWriter struct {
+	f      *os.File
+	offset int64
+}
+
+func newSparseWriter(f *os.File) *sparseWriter {
+	return &sparseWriter{f: f}
+}
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *sparseWriter) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		n := sparseBlockSize
+		if len(b) < n {
+			n = len(b)
+		}
+		block := b[:n]
+		if !isZero(block) {
+			if _, err := s.f.WriteAt(block, s.offset); err != nil {
+				return written, err
+			}
+		}
+		s.offset += int64(n)
+		written += n
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// Close sets the final size of the file, so trailing holes are preserved.
+// It does not close the underlying file.
+func (s *sparseWriter) Close() error {
+	return s.f.Truncate(s.offset)
+}
+
+var _ io.WriteCloser = &sparseWriter{}
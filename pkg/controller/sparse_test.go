@@ -0,0 +1,263 @@
+package controller
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spectrocloud/peg/pkg/machine/types"
+	"golang.org/x/crypto/ssh"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("sparseWriter", func() {
+	It("streams multi-GB sparse files with constant memory, keeping holes", func() {
+		dir, err := os.MkdirTemp("", "peg-sparse")
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(os.RemoveAll, dir)
+
+		const size = int64(2 << 30)
+		data := []byte("peg")
+
+		src, err := os.Create(filepath.Join(dir, "src.img"))
+		Expect(err).ToNot(HaveOccurred())
+		defer src.Close()
+		Expect(src.Truncate(size)).To(Succeed())
+		_, err = src.WriteAt(data, size/2)
+		Expect(err).ToNot(HaveOccurred())
+
+		dst, err := os.Create(filepath.Join(dir, "dst.img"))
+		Expect(err).ToNot(HaveOccurred())
+		defer dst.Close()
+
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+
+		w := newSparseWriter(dst)
+		n, err := io.Copy(w, io.LimitReader(src, size))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(n).To(Equal(size))
+		Expect(w.Close()).To(Succeed())
+
+		runtime.ReadMemStats(&after)
+		Expect(after.TotalAlloc - before.TotalAlloc).To(BeNumerically("<", 16<<20))
+
+		stat, err := dst.Stat()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(stat.Size()).To(Equal(size))
+		Expect(stat.Sys().(*syscall.Stat_t).Blocks * 512).To(BeNumerically("<", 1<<20))
+
+		got := make([]byte, len(data))
+		_, err = dst.ReadAt(got, size/2)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(got).To(Equal(data))
+	})
+})
+
+// scpMachine is a machine whose SSH server is served in process by serveSCP.
+type scpMachine struct {
+	types.Machine
+	mc types.MachineConfig
+}
+
+func (m scpMachine) Config() types.MachineConfig {
+	return m.mc
+}
+
+// serveSCP serves on l a minimal SSH server implementing the subset of the
+// scp protocol used by go-scp, streaming files from and to the local disk.
+func serveSCP(l net.Listener) {
+	_, key, err := ed25519.GenerateKey(nil)
+	Expect(err).ToNot(HaveOccurred())
+	signer, err := ssh.NewSignerFromKey(key)
+	Expect(err).ToNot(HaveOccurred())
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(_ ssh.ConnMetadata, _ []byte) (*ssh.Permissions, error) {
+			return nil, nil
+		},
+	}
+	config.AddHostKey(signer)
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer GinkgoRecover()
+			_, chans, reqs, err := ssh.NewServerConn(conn, config)
+			if err != nil {
+				return
+			}
+			go ssh.DiscardRequests(reqs)
+			for nc := range chans {
+				ch, chReqs, err := nc.Accept()
+				Expect(err).ToNot(HaveOccurred())
+				go serveSCPSession(ch, chReqs)
+			}
+		}()
+	}
+}
+
+func serveSCPSession(ch ssh.Channel, reqs <-chan *ssh.Request) {
+	defer GinkgoRecover()
+	defer ch.Close()
+
+	for req := range reqs {
+		if req.Type != "exec" {
+			_ = req.Reply(false, nil)
+			continue
+		}
+		var payload struct{ Command string }
+		Expect(ssh.Unmarshal(req.Payload, &payload)).To(Succeed())
+		Expect(req.Reply(true, nil)).To(Succeed())
+
+		// go-scp runs `scp -qt "path"` to send and `scp -f "path"` to receive
+		flag, quoted, _ := strings.Cut(strings.TrimPrefix(payload.Command, "scp "), " ")
+		path, err := strconv.Unquote(quoted)
+		Expect(err).ToNot(HaveOccurred())
+
+		r := bufio.NewReader(ch)
+		switch flag {
+		case "-qt":
+			header, err := r.ReadString('\n')
+			Expect(err).ToNot(HaveOccurred())
+			var mode, name string
+			var size int64
+			_, err = fmt.Sscanf(header, "C%s %d %s", &mode, &size, &name)
+			Expect(err).ToNot(HaveOccurred())
+			_, err = ch.Write([]byte{0})
+			Expect(err).ToNot(HaveOccurred())
+
+			f, err := os.Create(path)
+			Expect(err).ToNot(HaveOccurred())
+			w := newSparseWriter(f)
+			_, err = io.CopyN(w, r, size)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(w.Close()).To(Succeed())
+			Expect(f.Close()).To(Succeed())
+
+			_, err = r.ReadByte()
+			Expect(err).ToNot(HaveOccurred())
+			_, err = ch.Write([]byte{0})
+			Expect(err).ToNot(HaveOccurred())
+		case "-f":
+			f, err := os.Open(path)
+			Expect(err).ToNot(HaveOccurred())
+			stat, err := f.Stat()
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = r.ReadByte()
+			Expect(err).ToNot(HaveOccurred())
+			_, err = fmt.Fprintf(ch, "C0644 %d %s\n", stat.Size(), filepath.Base(path))
+			Expect(err).ToNot(HaveOccurred())
+			_, err = r.ReadByte()
+			Expect(err).ToNot(HaveOccurred())
+			_, err = io.Copy(ch, f)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(f.Close()).To(Succeed())
+			_, err = r.ReadByte()
+			Expect(err).ToNot(HaveOccurred())
+		default:
+			Fail("unexpected scp command: " + payload.Command)
+		}
+
+		_, err = ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{0}))
+		Expect(err).ToNot(HaveOccurred())
+		return
+	}
+}
+
+// maxHeapDuring returns how much the heap grew at most while f ran.
+func maxHeapDuring(f func()) uint64 {
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	base := stats.HeapInuse
+
+	var peak uint64
+	done := make(chan struct{})
+	sampled := make(chan struct{})
+	go func() {
+		defer close(sampled)
+		t := time.NewTicker(20 * time.Millisecond)
+		defer t.Stop()
+		for {
+			var s runtime.MemStats
+			runtime.ReadMemStats(&s)
+			if s.HeapInuse > base && s.HeapInuse-base > peak {
+				peak = s.HeapInuse - base
+			}
+			select {
+			case <-done:
+				return
+			case <-t.C:
+			}
+		}
+	}()
+
+	f()
+	close(done)
+	<-sampled
+	return peak
+}
+
+var _ = Describe("SendFile and ReceiveFile", func() {
+	It("stream multi-GB sparse files with constant memory", func() {
+		dir, err := os.MkdirTemp("", "peg-scp")
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(os.RemoveAll, dir)
+
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(l.Close)
+		go serveSCP(l)
+
+		_, port, err := net.SplitHostPort(l.Addr().String())
+		Expect(err).ToNot(HaveOccurred())
+		m := scpMachine{mc: types.MachineConfig{SSH: &types.SSH{User: "peg", Pass: "peg", Port: port}}}
+
+		const size = int64(2 << 30)
+		data := []byte("peg")
+
+		src := filepath.Join(dir, "src.img")
+		f, err := os.Create(src)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(f.Truncate(size)).To(Succeed())
+		_, err = f.WriteAt(data, size/2)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(f.Close()).To(Succeed())
+
+		sent := filepath.Join(dir, "sent.img")
+		received := filepath.Join(dir, "received.img")
+		peak := maxHeapDuring(func() {
+			Expect(SendFile(m, src, sent, "0644")).To(Succeed())
+			Expect(ReceiveFile(m, sent, received)).To(Succeed())
+		})
+		Expect(peak).To(BeNumerically("<", 64<<20))
+
+		f, err = os.Open(received)
+		Expect(err).ToNot(HaveOccurred())
+		defer f.Close()
+		stat, err := f.Stat()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(stat.Size()).To(Equal(size))
+		Expect(stat.Sys().(*syscall.Stat_t).Blocks * 512).To(BeNumerically("<", 1<<20))
+
+		got := make([]byte, len(data))
+		_, err = f.ReadAt(got, size/2)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(got).To(Equal(data))
+	})
+})
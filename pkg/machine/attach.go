@@ -0,0 +1,83 @@
+package machine
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/spectrocloud/peg/pkg/machine/types"
+	"gopkg.in/yaml.v3"
+)
+
+// machineConfigName is the file in the state dir where the config of a QEMU machine is recorded.
+const machineConfigName = "machine.yaml"
+
+// persistedConfig returns a copy of mc without its secrets, the SSH password
+// and the passphrases of the encrypted disks, to be recorded in the state dir.
+func persistedConfig(mc types.MachineConfig) types.MachineConfig {
+	if mc.SSH != nil {
+		ssh := *mc.SSH
+		ssh.Pass = ""
+		mc.SSH = &ssh
+	}
+	disks := make([]types.DriveConfig, len(mc.Disks))
+	for i, d := range mc.Disks {
+		if d.Encryption != nil {
+			enc := *d.Encryption
+			enc.Passphrase = ""
+			d.Encryption = &enc
+		}
+		disks[i] = d
+	}
+	mc.Disks = disks
+	return mc
+}
+
+// saveConfig records mc in its state dir, so that the machine can be attached to later.
+func saveConfig(mc types.MachineConfig) error {
+	dat, err := yaml.Marshal(persistedConfig(mc))
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(mc.StateDir, os.ModePerm); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(mc.StateDir, machineConfigName), dat, 0600)
+}
+
+// Attach returns the QEMU machine running from stateDir, e.g. started by another
+// process, so that it can be managed as if it was created by this one.
+// Hooks (OnFailure, PostCreate), custom host key callbacks and secrets (the
+// SSH password and disk passphrases) are not recorded, opts are applied to
+// the recorded config to set them again, e.g. with types.WithSSHPass.
+func Attach(stateDir string, opts ...types.MachineOption) (types.Machine, error) {
+	dat, err := os.ReadFile(filepath.Join(stateDir, machineConfigName))
+	if err != nil {
+		return nil, fmt.Errorf("reading machine config: %w", err)
+	}
+
+	mc := types.DefaultMachineConfig()
+	if err := yaml.Unmarshal(dat, mc); err != nil {
+		return nil, fmt.Errorf("parsing machine config: %w", err)
+	}
+	mc.StateDir = stateDir
+	if err := mc.Apply(opts...); err != nil {
+		return nil, err
+	}
+
+	if mc.Engine != types.QEMU {
+		return nil, fmt.Errorf("attaching to %s machines is not supported", mc.Engine)
+	}
+
+	q := &QEMU{machineConfig: *mc}
+	if !q.Alive() {
+		return nil, fmt.Errorf("machine %s in %s is not running", mc.ID, stateDir)
+	}
+
+	// This process manages the machine from now on, see FindOrphans
+	if err := recordOwner(stateDir); err != nil {
+		return nil, fmt.Errorf("recording machine owner: %w", err)
+	}
+	register(q)
+	return q, nil
+}
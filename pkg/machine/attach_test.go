@@ -0,0 +1,48 @@
+package machine
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/spectrocloud/peg/pkg/machine/types"
+	"gopkg.in/yaml.v3"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("saveConfig", func() {
+	It("records the config without its secrets", func() {
+		dir, err := os.MkdirTemp("", "peg-config")
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(os.RemoveAll, dir)
+
+		mc := types.DefaultMachineConfig()
+		Expect(mc.Apply(
+			types.WithStateDir(dir),
+			types.WithCPU("4"),
+			types.WithCPUType("host"),
+			types.WithSSHUser("peg"),
+			types.WithSSHPass("secret"),
+		)).To(Succeed())
+		mc.Disks = []types.DriveConfig{{Path: "/disks/data.qcow2", Encryption: &types.DriveEncryption{Passphrase: "secret"}}}
+
+		Expect(saveConfig(*mc)).To(Succeed())
+
+		dat, err := os.ReadFile(filepath.Join(dir, machineConfigName))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(dat)).ToNot(ContainSubstring("secret"))
+
+		got := types.MachineConfig{}
+		Expect(yaml.Unmarshal(dat, &got)).To(Succeed())
+		Expect(got).To(Equal(persistedConfig(*mc)))
+		Expect(got.CPU).To(Equal("4"))
+		Expect(got.CPUType).To(Equal("host"))
+		Expect(got.SSH.Pass).To(BeEmpty())
+		Expect(got.Disks[0].Encryption.Passphrase).To(BeEmpty())
+
+		// The config of the machine itself keeps its secrets
+		Expect(mc.SSH.Pass).To(Equal("secret"))
+		Expect(mc.Disks[0].Encryption.Passphrase).To(Equal("secret"))
+	})
+})
@@ -0,0 +1,74 @@
+package machine
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// defaultCgroupParent is where the cgroups of the machines are created.
+	defaultCgroupParent = "/sys/fs/cgroup/peg"
+	// cgroupCPUPeriod is the cpu.max period, in microseconds.
+	cgroupCPUPeriod = 100000
+	// cgroupCPUOverhead is the CPU share allowed on top of the vCPUs, for the
+	// emulation and I/O threads of qemu.
+	cgroupCPUOverhead = 0.5
+	// cgroupMemoryOverheadMiB is the memory allowed on top of the guest memory.
+	cgroupMemoryOverheadMiB = 512
+)
+
+// cgroupPath returns the cgroup of the machine.
+func (q *QEMU) cgroupPath() string {
+	parent := q.machineConfig.CgroupParent
+	if parent == "" {
+		parent = defaultCgroupParent
+	}
+	return filepath.Join(parent, "peg-"+q.machineConfig.ID)
+}
+
+// applyCgroup moves the qemu process to a new cgroup limiting its CPU and memory.
+func (q *QEMU) applyCgroup() error {
+	if !q.machineConfig.Cgroup {
+		return nil
+	}
+
+	vcpus, err := vcpuCount(q.machineConfig)
+	if err != nil {
+		return err
+	}
+	mem, err := memoryMiB(q.machineConfig)
+	if err != nil {
+		return err
+	}
+	pid, err := q.readStateFile("pid")
+	if err != nil {
+		return fmt.Errorf("reading qemu pid: %w", err)
+	}
+
+	parent := filepath.Dir(q.cgroupPath())
+	quota := int((float64(vcpus) + cgroupCPUOverhead) * cgroupCPUPeriod)
+	script := strings.Join([]string{
+		fmt.Sprintf("mkdir -p %s", shellQuote(q.cgroupPath())),
+		// The controllers have to be enabled in the parent to set limits in its children
+		fmt.Sprintf("echo '+cpu +memory' > %s", shellQuote(filepath.Join(parent, "cgroup.subtree_control"))),
+		fmt.Sprintf("echo '%d %d' > %s", quota, cgroupCPUPeriod, shellQuote(filepath.Join(q.cgroupPath(), "cpu.max"))),
+		fmt.Sprintf("echo %d > %s", (mem+cgroupMemoryOverheadMiB)*1024*1024, shellQuote(filepath.Join(q.cgroupPath(), "memory.max"))),
+		fmt.Sprintf("echo %s > %s", strings.TrimSpace(string(pid)), shellQuote(filepath.Join(q.cgroupPath(), "cgroup.procs"))),
+	}, " && ")
+	if out, err := q.hostSH(script); err != nil {
+		return fmt.Errorf("setting up cgroup %s: %w - %s", q.cgroupPath(), err, out)
+	}
+	return nil
+}
+
+// removeCgroup removes the cgroup created by applyCgroup, once qemu has exited.
+func (q *QEMU) removeCgroup() error {
+	if !q.machineConfig.Cgroup {
+		return nil
+	}
+	if out, err := q.hostSH(fmt.Sprintf("if [ -d %[1]s ]; then rmdir %[1]s; fi", shellQuote(q.cgroupPath()))); err != nil {
+		return fmt.Errorf("removing cgroup %s: %w - %s", q.cgroupPath(), err, out)
+	}
+	return nil
+}
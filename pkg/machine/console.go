@@ -0,0 +1,24 @@
+package machine
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"path"
+)
+
+// consoleSockFile returns the socket of the console name inside the state dir.
+func (q *QEMU) consoleSockFile(name string) string {
+	return path.Join(q.machineConfig.StateDir, fmt.Sprintf("console-%s.sock", name))
+}
+
+// ReadConsole connects to the virtio console name and returns what the guest
+// writes to it. Only one reader can be connected at a time, output written
+// while no reader is connected is lost.
+func (q *QEMU) ReadConsole(name string) (io.ReadCloser, error) {
+	sock, err := q.ConsoleSocketPath(name)
+	if err != nil {
+		return nil, err
+	}
+	return net.Dial("unix", sock)
+}
@@ -7,6 +7,7 @@ import (
 	"strings"
 
 	"github.com/spectrocloud/peg/internal/utils"
+	"github.com/spectrocloud/peg/pkg/controller"
 	"github.com/spectrocloud/peg/pkg/machine/types"
 )
 
@@ -23,18 +24,27 @@ func (q *Docker) whereIsDocker() string {
 }
 
 func (q *Docker) Create(ctx context.Context) (context.Context, error) {
+	release, err := acquireCreate(ctx)
+	if err != nil {
+		return ctx, err
+	}
+
 	log.Info("Create docker machine")
+	register(q)
 
 	processName := q.whereIsDocker()
 
 	log.Infof("Starting Docker container with %s. Image: %s", processName, q.machineConfig.Image)
 
-	cmd := fmt.Sprintf("%s run %s --entrypoint /bin/sh -d -t --name %s %s", processName, strings.Join(q.machineConfig.Args, " "), q.machineConfig.ID, q.machineConfig.Image)
+	cmd := fmt.Sprintf("%s run %s --entrypoint %s -d -t --name %s %s", processName, strings.Join(q.machineConfig.Args, " "), q.shell(), q.machineConfig.ID, q.machineConfig.Image)
 	out, err := utils.SH(cmd)
+	// The container is running, don't hold the slot through a slow PostCreate
+	release()
 	if err != nil {
-		return ctx, fmt.Errorf("failed creating container: %w - cmd: %s, out: %s", err, cmd, out)
+		return ctx, failed(q.machineConfig, fmt.Errorf("failed creating container: %w - cmd: %s, out: %s", err, cmd, out))
 	}
-	return ctx, nil
+	q.machineConfig.Emit(types.EventProcessStarted, strings.TrimSpace(out))
+	return ctx, failed(q.machineConfig, postCreate(q))
 }
 func (q *Docker) Screenshot() (string, error) {
 	return "", errors.New("Screenshot is not implemented in docker machine")
@@ -44,7 +54,9 @@ func (q *Docker) Config() types.MachineConfig {
 	return q.machineConfig
 }
 
+// Stop stops the container and removes the machine from the registry, see CleanupAll.
 func (q *Docker) Stop() error {
+	unregister(q)
 	out, err := utils.SH(fmt.Sprintf("%s stop %s", q.whereIsDocker(), q.machineConfig.ID))
 	if err != nil {
 		return fmt.Errorf("failed stopping container: %w - %s", err, out)
@@ -61,6 +73,7 @@ func (q *Docker) Clean() error {
 	if err != nil {
 		log.Warn("failed deleting image: %w s %s", err.Error(), out)
 	}
+	unregister(q)
 	return nil
 }
 
@@ -80,10 +93,18 @@ func (q *Docker) CreateDisk(_, _ string) error {
 }
 
 func (q *Docker) Command(cmd string) (string, error) {
-	generatedCmd := fmt.Sprintf("%s exec %s /bin/sh -c '%s'", q.whereIsDocker(), q.machineConfig.ID, cmd)
+	return q.CommandContext(context.Background(), cmd)
+}
+
+func (q *Docker) CommandContext(ctx context.Context, cmd string) (string, error) {
+	generatedCmd := fmt.Sprintf("%s exec %s %s -c %s", q.whereIsDocker(), q.machineConfig.ID, q.shell(), shellQuote(controller.WrapCommand(q, cmd)))
 	log.Infof("Running command: ", generatedCmd)
 
-	return utils.SH(generatedCmd)
+	out, err := utils.SHContext(ctx, generatedCmd)
+	if ctx.Err() != nil {
+		return out, ctx.Err()
+	}
+	return out, err
 }
 
 func (q *Docker) DetachCD() error {
@@ -105,3 +126,11 @@ func (q *Docker) SendFile(src, dst, _ string) error {
 	}
 	return nil
 }
+
+// shell returns the shell used to run commands in the container.
+func (q *Docker) shell() string {
+	if q.machineConfig.SSH != nil && q.machineConfig.SSH.Shell != "" {
+		return q.machineConfig.SSH.Shell
+	}
+	return "/bin/sh"
+}
@@ -0,0 +1,44 @@
+package machine
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/spectrocloud/peg/internal/utils"
+)
+
+// writeSecret stores passphrase in the state dir, readable only by the
+// current user, to be passed to qemu in a secret object.
+func (q *QEMU) writeSecret(name, passphrase string) (string, error) {
+	if q.machineConfig.RemoteHost != nil {
+		return "", errors.New("encrypted disks are not supported for machines on a remote host")
+	}
+	if err := os.MkdirAll(q.machineConfig.StateDir, os.ModePerm); err != nil {
+		return "", err
+	}
+
+	f := filepath.Join(q.machineConfig.StateDir, name+".secret")
+	if err := os.WriteFile(f, []byte(passphrase), 0600); err != nil {
+		return "", fmt.Errorf("writing secret: %w", err)
+	}
+	return f, nil
+}
+
+// CreateEncryptedDisk creates a LUKS encrypted qcow2 disk in the state dir,
+// to be attached with a DriveConfig having the same passphrase.
+func (q *QEMU) CreateEncryptedDisk(diskname, size, passphrase string) error {
+	secret, err := q.writeSecret(diskname, passphrase)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(secret)
+
+	out, err := utils.SH(fmt.Sprintf("qemu-img create -f qcow2 --object secret,id=sec0,file=%s -o encrypt.format=luks,encrypt.key-secret=sec0 %s %s",
+		secret, filepath.Join(q.machineConfig.StateDir, diskname), size))
+	if err != nil {
+		return fmt.Errorf("%s : %w", out, err)
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package machine
+
+import "errors"
+
+var (
+	// ErrDiskCreate is wrapped by the errors creating disks.
+	ErrDiskCreate = errors.New("disk creation failed")
+	// ErrMonitorUnreachable is wrapped by the errors connecting to the qemu monitor.
+	ErrMonitorUnreachable = errors.New("qemu monitor unreachable")
+	// ErrProcessExited is wrapped by the errors of Create when the machine
+	// process exits right after starting.
+	ErrProcessExited = errors.New("machine process exited")
+)
+
+// kindError tags err with kind, one of the errors above, so that callers can
+// check it with errors.Is, without changing its message.
+type kindError struct {
+	kind error
+	err  error
+}
+
+func (e kindError) Error() string {
+	return e.err.Error()
+}
+
+func (e kindError) Unwrap() []error {
+	return []error{e.kind, e.err}
+}
+
+// withKind tags err with kind, it returns nil if err is nil.
+func withKind(kind, err error) error {
+	if err == nil {
+		return nil
+	}
+	return kindError{kind: kind, err: err}
+}
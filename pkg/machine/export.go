@@ -0,0 +1,38 @@
+package machine
+
+import (
+	"errors"
+	"fmt"
+)
+
+// exportFormats maps the formats accepted by Export to qemu-img output formats.
+var exportFormats = map[string]string{
+	"raw":   "raw",
+	"qcow2": "qcow2",
+	"vmdk":  "vmdk",
+	"vdi":   "vdi",
+}
+
+// Export converts the primary disk of the stopped machine to outPath in
+// format, one of "raw", "qcow2", "vmdk" or "vdi", e.g. to reuse an image
+// prepared by a test with other tools.
+func (q *QEMU) Export(format, outPath string) error {
+	imgFormat, ok := exportFormats[format]
+	if !ok {
+		return fmt.Errorf("invalid export format %q", format)
+	}
+	if q.Alive() {
+		return errors.New("the machine must be stopped to export its disk")
+	}
+
+	disk, err := q.primaryDisk()
+	if err != nil {
+		return err
+	}
+
+	out, err := q.hostSH(fmt.Sprintf("qemu-img convert -O %s %s %s", imgFormat, shellQuote(disk), shellQuote(outPath)))
+	if err != nil {
+		return fmt.Errorf("exporting %s to %s: %w - %s", disk, outPath, err, out)
+	}
+	return nil
+}
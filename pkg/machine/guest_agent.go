@@ -0,0 +1,193 @@
+package machine
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"path"
+	"time"
+)
+
+// guestAgentSockName is the name of the socket of the guest agent channel inside the state dir.
+const guestAgentSockName = "qemu-ga.sock"
+
+// guestAgentTimeout bounds a single guest agent request when the context has no deadline.
+const guestAgentTimeout = 5 * time.Second
+
+// guestAgentProbeTimeout bounds how long HasGuestAgent waits for an answer.
+const guestAgentProbeTimeout = 2 * time.Second
+
+// ErrGuestAgentUnavailable is returned when the guest agent doesn't answer,
+// usually because qemu-guest-agent is not installed in the guest, so that
+// callers can fall back to SSH.
+var ErrGuestAgentUnavailable = errors.New("the guest agent is not available")
+
+func (q *QEMU) guestAgentSockFile() string {
+	if q.machineConfig.GuestAgentSocket != "" {
+		return q.machineConfig.GuestAgentSocket
+	}
+	return path.Join(q.machineConfig.StateDir, guestAgentSockName)
+}
+
+// guestAgentResponse is a reply of the guest agent.
+type guestAgentResponse struct {
+	Return json.RawMessage `json:"return"`
+	Error  *struct {
+		Class string `json:"class"`
+		Desc  string `json:"desc"`
+	} `json:"error"`
+}
+
+// WaitForGuestAgent waits until the guest agent answers to pings, or ctx expires.
+func (q *QEMU) WaitForGuestAgent(ctx context.Context) error {
+	for {
+		err := q.guestAgentRequest(ctx, "guest-ping", nil, nil)
+		if err == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w: %w (last error: %s)", ErrGuestAgentUnavailable, ctx.Err(), err.Error())
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// GuestAgentCommand runs command with args through the guest agent, waiting
+// for the agent to be up first, and unmarshals its return value into result
+// if not nil. See https://qemu.readthedocs.io/en/latest/interop/qemu-ga-ref.html
+func (q *QEMU) GuestAgentCommand(ctx context.Context, command string, args, result interface{}) error {
+	if err := q.WaitForGuestAgent(ctx); err != nil {
+		return err
+	}
+	return q.guestAgentRequest(ctx, command, args, result)
+}
+
+// HasGuestAgent reports whether the guest agent answers right now.
+func (q *QEMU) HasGuestAgent() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), guestAgentProbeTimeout)
+	defer cancel()
+	return q.guestAgentRequest(ctx, "guest-ping", nil, nil) == nil
+}
+
+// GuestIPAddresses returns the IP addresses of the guest, except loopback
+// ones, as reported by the guest agent. It returns ErrGuestAgentUnavailable
+// right away when the agent doesn't answer.
+func (q *QEMU) GuestIPAddresses() ([]string, error) {
+	if !q.HasGuestAgent() {
+		return nil, ErrGuestAgentUnavailable
+	}
+
+	var ifaces []struct {
+		Name        string `json:"name"`
+		IPAddresses []struct {
+			Address string `json:"ip-address"`
+		} `json:"ip-addresses"`
+	}
+	if err := q.guestAgentRequest(context.Background(), "guest-network-get-interfaces", nil, &ifaces); err != nil {
+		return nil, err
+	}
+
+	ips := []string{}
+	for _, i := range ifaces {
+		for _, a := range i.IPAddresses {
+			if ip := net.ParseIP(a.Address); ip != nil && !ip.IsLoopback() {
+				ips = append(ips, a.Address)
+			}
+		}
+	}
+	return ips, nil
+}
+
+// GuestFS is a filesystem mounted in the guest, as reported by the guest agent.
+type GuestFS struct {
+	Name       string `json:"name"`
+	Mountpoint string `json:"mountpoint"`
+	Type       string `json:"type"`
+	// TotalBytes and UsedBytes are only reported by recent agents
+	TotalBytes uint64 `json:"total-bytes"`
+	UsedBytes  uint64 `json:"used-bytes"`
+}
+
+// GuestFSInfo returns the filesystems mounted in the guest. It returns
+// ErrGuestAgentUnavailable right away when the agent doesn't answer.
+func (q *QEMU) GuestFSInfo() ([]GuestFS, error) {
+	if !q.HasGuestAgent() {
+		return nil, ErrGuestAgentUnavailable
+	}
+
+	fs := []GuestFS{}
+	if err := q.guestAgentRequest(context.Background(), "guest-get-fsinfo", nil, &fs); err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
+
+// guestAgentRequest sends a single command to the guest agent.
+func (q *QEMU) guestAgentRequest(ctx context.Context, command string, args, result interface{}) error {
+	if q.machineConfig.RemoteHost != nil {
+		return fmt.Errorf("%w for machines on a remote host", ErrGuestAgentUnavailable)
+	}
+
+	// The channel accepts a single client at a time
+	q.agentLock.Lock()
+	defer q.agentLock.Unlock()
+
+	deadline, ok := ctx.Deadline()
+	if !ok || time.Until(deadline) > guestAgentTimeout {
+		deadline = time.Now().Add(guestAgentTimeout)
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "unix", q.guestAgentSockFile())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(deadline); err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(conn)
+	dec := json.NewDecoder(conn)
+
+	// Requests sent while the agent was down are answered once it starts, sync
+	// first so that stale replies are skipped
+	id := rand.Int63n(1 << 31)
+	if err := enc.Encode(map[string]interface{}{"execute": "guest-sync", "arguments": map[string]int64{"id": id}}); err != nil {
+		return err
+	}
+	for {
+		var resp guestAgentResponse
+		if err := dec.Decode(&resp); err != nil {
+			return fmt.Errorf("syncing with the guest agent: %w", err)
+		}
+		var got int64
+		if json.Unmarshal(resp.Return, &got) == nil && got == id {
+			break
+		}
+	}
+
+	req := map[string]interface{}{"execute": command}
+	if args != nil {
+		req["arguments"] = args
+	}
+	if err := enc.Encode(req); err != nil {
+		return err
+	}
+
+	var resp guestAgentResponse
+	if err := dec.Decode(&resp); err != nil {
+		return fmt.Errorf("reading guest agent reply to %s: %w", command, err)
+	}
+	if resp.Error != nil {
+		return fmt.Errorf("guest agent %s failed: %s: %s", command, resp.Error.Class, resp.Error.Desc)
+	}
+	if result != nil {
+		return json.Unmarshal(resp.Return, result)
+	}
+	return nil
+}
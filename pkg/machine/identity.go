@@ -0,0 +1,37 @@
+package machine
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"regexp"
+)
+
+var uuidRe = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// uuid returns the UUID of the machine, empty to let qemu pick one.
+func (q *QEMU) uuid() (string, error) {
+	if q.machineConfig.UUID != "" {
+		if !uuidRe.MatchString(q.machineConfig.UUID) {
+			return "", fmt.Errorf("invalid UUID %q", q.machineConfig.UUID)
+		}
+		return q.machineConfig.UUID, nil
+	}
+	if q.machineConfig.Seed != "" {
+		return seededUUID(q.machineConfig.Seed), nil
+	}
+	return "", nil
+}
+
+// seededUUID derives a name based (version 5 like) UUID from seed.
+func seededUUID(seed string) string {
+	h := sha256.Sum256([]byte("uuid:" + seed))
+	h[6] = (h[6] & 0x0f) | 0x50
+	h[8] = (h[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", h[0:4], h[4:6], h[6:8], h[8:10], h[10:16])
+}
+
+// seededMAC derives the MAC address of the i-th NIC from seed, in the range used by qemu.
+func seededMAC(seed string, i int) string {
+	h := sha256.Sum256([]byte(fmt.Sprintf("mac:%s:%d", seed, i)))
+	return fmt.Sprintf("52:54:00:%02x:%02x:%02x", h[0], h[1], h[2])
+}
@@ -4,6 +4,8 @@ import (
 	"context"
 	"crypto/rand"
 	"fmt"
+	mrand "math/rand"
+	"net"
 	"os"
 	"path/filepath"
 	"strings"
@@ -11,7 +13,6 @@ import (
 
 	"github.com/codingsince1985/checksum"
 	logging "github.com/ipfs/go-log"
-	process "github.com/mudler/go-processmanager"
 	"github.com/phayes/freeport"
 	"github.com/spectrocloud/peg/internal/signals"
 	"github.com/spectrocloud/peg/pkg/machine/internal/utils"
@@ -24,14 +25,28 @@ func checksumErr(got, expected string) error {
 	return fmt.Errorf("checksum mismatch: got %s, expected %s", got, expected)
 }
 
+// tempDir returns the directory to use for scratch files of the machine.
+func tempDir(mc types.MachineConfig) string {
+	if mc.TempDir != "" {
+		return mc.TempDir
+	}
+	return os.TempDir()
+}
+
 func prepare(mc *types.MachineConfig) error {
 	if mc.ID == "" {
 		mc.ID = RandStringRunes(10)
 		log.Infof("Automatically generated machine with id: %s", mc.ID)
 	}
 
+	if mc.TempDir != "" {
+		if err := os.MkdirAll(mc.TempDir, os.ModePerm); err != nil {
+			return err
+		}
+	}
+
 	if mc.StateDir == "" {
-		f, err := os.MkdirTemp("", "peg")
+		f, err := os.MkdirTemp(tempDir(*mc), "peg")
 		if err != nil {
 			return err
 		}
@@ -42,13 +57,25 @@ func prepare(mc *types.MachineConfig) error {
 		})
 	}
 
+	// Guests of a remote qemu are reached through the ports forwarded on the remote host
+	if mc.RemoteHost != nil && mc.SSH.Host == "" {
+		mc.SSH.Host = mc.RemoteHost.Host
+	}
+
 	if mc.SSH.Port == "" {
-		port, err := freeport.GetFreePort()
+		allocate := AllocateFreePort
+		if mc.RemoteHost != nil {
+			// The port is forwarded on the remote host, look for a free one there
+			allocate = func(min, max int) (int, error) {
+				return allocateRemotePort(mc.RemoteHost, func(c string) (string, error) { return remoteSH(mc.RemoteHost, c, false) }, min, max)
+			}
+		}
+		port, err := allocate(mc.SSH.PortMin, mc.SSH.PortMax)
 		if err != nil {
 			return err
 		}
 		mc.SSH.Port = fmt.Sprint(port)
-		log.Infof("Automatically generated local SSH port: %s", mc.SSH.Port)
+		log.Infof("Automatically generated SSH port: %s", mc.SSH.Port)
 	}
 
 	if utils.IsValidURL(mc.ISO) {
@@ -117,7 +144,64 @@ func prepare(mc *types.MachineConfig) error {
 	return nil
 }
 
-func monitor(ctx context.Context, p *process.Process, f func(p *process.Process)) context.Context {
+// AllocateFreePort returns a free local TCP port between min and max (inclusive).
+// If both are 0, any free port is returned.
+func AllocateFreePort(min, max int) (int, error) {
+	if min == 0 && max == 0 {
+		return freeport.GetFreePort()
+	}
+	if min <= 0 || max > 65535 || min > max {
+		return 0, fmt.Errorf("invalid port range %d-%d", min, max)
+	}
+
+	// Start from a random port, so that concurrent allocations are less likely to collide
+	size := max - min + 1
+	start := mrand.Intn(size)
+	for i := 0; i < size; i++ {
+		port := min + (start+i)%size
+		// qemu forwards the port on all the interfaces, so it has to be free on all of them
+		l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+		if err != nil {
+			continue
+		}
+		l.Close()
+		return port, nil
+	}
+
+	return 0, fmt.Errorf("no free port in range %d-%d", min, max)
+}
+
+// postCreate runs the PostCreate hook of m, stopping m if it fails.
+func postCreate(m types.Machine) error {
+	f := m.Config().PostCreate
+	if f == nil {
+		return nil
+	}
+	if err := f(m); err != nil {
+		if stopErr := m.Stop(); stopErr != nil {
+			log.Warnf("Failed stopping machine %s after post create failure: %s", m.Config().ID, stopErr.Error())
+		}
+		return fmt.Errorf("post create hook: %w", err)
+	}
+	return nil
+}
+
+// failed emits a failed event for the machine when err is not nil, and returns err.
+func failed(mc types.MachineConfig, err error) error {
+	if err != nil {
+		mc.Emit(types.EventFailed, err.Error())
+	}
+	return err
+}
+
+// processHandle is the subset of a process used by monitor.
+type processHandle interface {
+	IsAlive() bool
+	ExitCode() (string, error)
+}
+
+// monitor watches p and calls f when the process exits with a non-zero exit code.
+func monitor(ctx context.Context, p processHandle, f func()) context.Context {
 	// A new context that will be "Done" when the process exits
 	// The caller can use it to monitor the process.
 	newCtx, cancelFunc := context.WithCancel(ctx)
@@ -132,7 +216,7 @@ func monitor(ctx context.Context, p *process.Process, f func(p *process.Process)
 				if !p.IsAlive() {
 					code, err := p.ExitCode()
 					if err != nil || code != "0" {
-						f(p)
+						f()
 					}
 					cancelFunc()
 					return
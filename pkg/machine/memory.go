@@ -0,0 +1,66 @@
+package machine
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/spectrocloud/peg/pkg/machine/types"
+)
+
+// memoryMiB returns the guest memory size in MiB, DefaultMemory if unset.
+func memoryMiB(mc types.MachineConfig) (uint64, error) {
+	mem := mc.Memory
+	if mem == "" {
+		mem = types.DefaultMemory
+	}
+	mib, err := types.ParseSizeMiB(mem)
+	if err != nil {
+		return 0, fmt.Errorf("memory: %w", err)
+	}
+	return mib, nil
+}
+
+// memoryOpts returns the qemu options locking and preallocating the guest memory.
+func (q *QEMU) memoryOpts() ([]string, error) {
+	var opts []string
+	if q.machineConfig.MemLock {
+		if err := q.checkMemLock(); err != nil {
+			return nil, err
+		}
+		opts = append(opts, "-overcommit", "mem-lock=on")
+	}
+	if q.machineConfig.MemPrealloc {
+		opts = append(opts, "-mem-prealloc")
+	}
+	return opts, nil
+}
+
+// checkMemLock warns when the locked memory limit of the host is lower than
+// the guest memory, as qemu fails to start if it can't lock it all.
+func (q *QEMU) checkMemLock() error {
+	mem, err := memoryMiB(q.machineConfig)
+	if err != nil {
+		return err
+	}
+
+	out, err := q.hostSH("ulimit -l")
+	if err != nil {
+		log.Warnf("Failed reading the locked memory limit: %s - %s", err.Error(), out)
+		return nil
+	}
+	limit := strings.TrimSpace(out)
+	if limit == "unlimited" {
+		return nil
+	}
+	// ulimit reports KiB
+	kib, err := strconv.ParseUint(limit, 10, 64)
+	if err != nil {
+		log.Warnf("Unexpected locked memory limit %q", limit)
+		return nil
+	}
+	if kib < mem*1024 {
+		log.Warnf("The locked memory limit (%d KiB) is lower than the guest memory (%d MiB), qemu may fail to start unless it runs with CAP_IPC_LOCK", kib, mem)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package machine
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// migrationTimeout bounds how long MigrateTo waits for the migration to complete.
+const migrationTimeout = 10 * time.Minute
+
+// MigrateTo live migrates the running machine to dest, which is created to
+// receive it, and stops this machine once done. Both machines need compatible
+// configs and different SSH ports when on the same host: tests have to connect
+// to dest afterwards. Unless dest has drives of its own, it uses the disks of
+// this machine, which must be reachable with the same paths from its host,
+// e.g. the same host or a shared filesystem.
+func (q *QEMU) MigrateTo(dest *QEMU) error {
+	if !q.Alive() {
+		return errors.New("the source machine is not running")
+	}
+	if dest.Alive() {
+		return errors.New("the destination machine must not be running")
+	}
+
+	// The migration stream is not authenticated, so only listen on the
+	// address the source connects to
+	host := "127.0.0.1"
+	if dest.machineConfig.RemoteHost != nil {
+		host = dest.machineConfig.RemoteHost.Host
+	} else if q.machineConfig.RemoteHost != nil {
+		return errors.New("migrating a machine from a remote host to the local host is not supported")
+	}
+	port, err := dest.allocateHostPort(0, 0)
+	if err != nil {
+		return err
+	}
+	uri := fmt.Sprintf("tcp:%s", net.JoinHostPort(host, fmt.Sprint(port)))
+
+	if len(dest.machineConfig.Drives) == 0 && len(dest.machineConfig.Disks) == 0 {
+		dest.machineConfig.Disks = q.drives
+	}
+	dest.incoming = uri
+	defer func() { dest.incoming = "" }()
+	if _, err := dest.Create(context.Background()); err != nil {
+		return fmt.Errorf("creating the migration destination: %w", err)
+	}
+
+	c, err := q.dialQMP()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	// MIGRATION events are only sent with the events capability
+	capabilities := map[string]interface{}{
+		"capabilities": []map[string]interface{}{{"capability": "events", "state": true}},
+	}
+	if err := c.execute("migrate-set-capabilities", capabilities, nil); err != nil {
+		return err
+	}
+	if err := c.execute("migrate", map[string]string{"uri": uri}, nil); err != nil {
+		return fmt.Errorf("starting migration: %w", err)
+	}
+
+	var status string
+	err = c.waitEvent("MIGRATION", time.Now().Add(migrationTimeout), func(data json.RawMessage) bool {
+		var ev struct {
+			Status string `json:"status"`
+		}
+		if json.Unmarshal(data, &ev) != nil {
+			return false
+		}
+		status = ev.Status
+		return status == "completed" || status == "failed" || status == "cancelled"
+	})
+	if err != nil {
+		// The session can't be reused after a timeout
+		c.Close()
+		_ = q.qmpCommand("migrate_cancel", nil, nil)
+		return fmt.Errorf("migration did not complete after %s: %w", migrationTimeout, err)
+	}
+	if status != "completed" {
+		return fmt.Errorf("migration did not complete: %s", status)
+	}
+
+	c.Close()
+	return q.Stop()
+}
@@ -0,0 +1,307 @@
+package machine
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spectrocloud/peg/internal/utils"
+)
+
+// primaryDisk returns the path of the first disk of the machine.
+func (q *QEMU) primaryDisk() (string, error) {
+	if len(q.machineConfig.Drives) > 0 {
+		return q.machineConfig.Drives[0], nil
+	}
+	if len(q.machineConfig.Disks) > 0 {
+		return q.machineConfig.Disks[0].Path, nil
+	}
+	auto := filepath.Join(q.machineConfig.StateDir, fmt.Sprintf("%s-0.img", q.machineConfig.ID))
+	if _, err := os.Stat(auto); err == nil {
+		return auto, nil
+	}
+	return "", errors.New("machine has no disk")
+}
+
+// connectNBD exposes the primary disk of the stopped machine as a /dev/nbdX device.
+func (q *QEMU) connectNBD(readOnly bool) (string, error) {
+	if os.Geteuid() != 0 {
+		return "", errors.New("accessing the disk offline requires root")
+	}
+	if q.Alive() {
+		return "", errors.New("the machine must be stopped to access its disk offline")
+	}
+
+	disk, err := q.primaryDisk()
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := os.Stat("/sys/module/nbd"); err != nil {
+		if out, err := utils.SH("modprobe nbd max_part=16"); err != nil {
+			return "", fmt.Errorf("nbd kernel module is not available: %w - %s", err, out)
+		}
+	}
+
+	devices, _ := filepath.Glob("/sys/block/nbd*")
+	for _, d := range devices {
+		// A zero sized device is not connected
+		size, err := os.ReadFile(filepath.Join(d, "size"))
+		if err != nil || strings.TrimSpace(string(size)) != "0" {
+			continue
+		}
+
+		dev := filepath.Join("/dev", filepath.Base(d))
+		args := fmt.Sprintf("--connect=%s", dev)
+		if readOnly {
+			args += " --read-only"
+		}
+		if out, err := utils.SH(fmt.Sprintf("qemu-nbd %s %s", args, shellQuote(disk))); err != nil {
+			return "", fmt.Errorf("connecting %s to %s: %w - %s", disk, dev, err, out)
+		}
+		// Let the kernel scan the partition table
+		_, _ = utils.SH(fmt.Sprintf("partprobe %s", shellQuote(dev)))
+		if err := waitForNBD(d); err != nil {
+			_ = disconnectNBD(dev)
+			return "", err
+		}
+		return dev, nil
+	}
+
+	return "", errors.New("no free nbd device found")
+}
+
+// nbdSettleTimeout bounds how long connectNBD waits for the device and its partitions to show up.
+const nbdSettleTimeout = 10 * time.Second
+
+// waitForNBD waits until the nbd device of sysDir, e.g. /sys/block/nbd0, is
+// connected and the device nodes of its partitions exist.
+func waitForNBD(sysDir string) error {
+	deadline := time.Now().Add(nbdSettleTimeout)
+	for {
+		if nbdReady(sysDir) {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s not ready after %s", filepath.Join("/dev", filepath.Base(sysDir)), nbdSettleTimeout)
+		}
+		// Wait for udev to create the device nodes, if it's there
+		if _, err := utils.SH("udevadm settle --timeout=1"); err != nil {
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+}
+
+func nbdReady(sysDir string) bool {
+	size, err := os.ReadFile(filepath.Join(sysDir, "size"))
+	if err != nil || strings.TrimSpace(string(size)) == "0" {
+		return false
+	}
+	parts, _ := filepath.Glob(filepath.Join(sysDir, filepath.Base(sysDir)+"p*"))
+	for _, p := range parts {
+		if _, err := os.Stat(filepath.Join("/dev", filepath.Base(p))); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func disconnectNBD(dev string) error {
+	if out, err := utils.SH(fmt.Sprintf("qemu-nbd --disconnect %s", shellQuote(dev))); err != nil {
+		return fmt.Errorf("disconnecting %s: %w - %s", dev, err, out)
+	}
+	return nil
+}
+
+// unmountableFSTypes are the lsblk FSTYPEs which are not filesystems that can
+// be mounted directly, e.g. encrypted or LVM partitions.
+var unmountableFSTypes = map[string]bool{
+	"crypto_LUKS":       true,
+	"LVM2_member":       true,
+	"linux_raid_member": true,
+	"zfs_member":        true,
+	"swap":              true,
+	"BitLocker":         true,
+	"bcache":            true,
+}
+
+// rootPartition returns the largest partition of dev holding a mountable
+// filesystem, or dev itself when it's not partitioned.
+func rootPartition(dev string) (string, error) {
+	out, err := utils.SH(fmt.Sprintf("lsblk -b -n -l -o PATH,SIZE,FSTYPE %s", shellQuote(dev)))
+	if err != nil {
+		return "", fmt.Errorf("listing partitions of %s: %w - %s", dev, err, out)
+	}
+
+	var part string
+	var partSize int64
+	for _, l := range strings.Split(strings.TrimSpace(out), "\n") {
+		fields := strings.Fields(l)
+		if len(fields) < 3 || unmountableFSTypes[fields[2]] {
+			continue
+		}
+		size, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		if size > partSize {
+			part, partSize = fields[0], size
+		}
+	}
+
+	if part == "" {
+		return "", fmt.Errorf("no mountable filesystem found on %s", dev)
+	}
+	return part, nil
+}
+
+// MountDisk mounts read-only the root partition of the stopped machine to a temporary
+// directory and returns it. It uses qemu-nbd, so it needs root and the nbd kernel module.
+// Call UnmountDisk once done.
+func (q *QEMU) MountDisk() (string, error) {
+	return q.mountDisk(true)
+}
+
+func (q *QEMU) mountDisk(readOnly bool) (string, error) {
+	if q.nbdDevice != "" {
+		return "", fmt.Errorf("disk already mounted at %s", q.mountPoint)
+	}
+
+	dev, err := q.connectNBD(readOnly)
+	if err != nil {
+		return "", err
+	}
+
+	part, err := rootPartition(dev)
+	if err != nil {
+		_ = disconnectNBD(dev)
+		return "", err
+	}
+
+	dir, err := os.MkdirTemp(tempDir(q.machineConfig), "peg-mount")
+	if err != nil {
+		_ = disconnectNBD(dev)
+		return "", err
+	}
+
+	opts := "rw"
+	if readOnly {
+		opts = "ro"
+	}
+	if out, err := utils.SH(fmt.Sprintf("mount -o %s %s %s", shellQuote(opts), shellQuote(part), shellQuote(dir))); err != nil {
+		_ = disconnectNBD(dev)
+		_ = os.Remove(dir)
+		return "", fmt.Errorf("mounting %s: %w - %s", part, err, out)
+	}
+
+	q.nbdDevice, q.mountPoint = dev, dir
+	return dir, nil
+}
+
+// UnmountDisk tears down what MountDisk set up.
+func (q *QEMU) UnmountDisk() error {
+	if q.nbdDevice == "" {
+		return nil
+	}
+
+	if out, err := utils.SH(fmt.Sprintf("umount %s", shellQuote(q.mountPoint))); err != nil {
+		return fmt.Errorf("unmounting %s: %w - %s", q.mountPoint, err, out)
+	}
+	if err := disconnectNBD(q.nbdDevice); err != nil {
+		return err
+	}
+	_ = os.Remove(q.mountPoint)
+
+	q.nbdDevice, q.mountPoint = "", ""
+	return nil
+}
+
+// InjectSSHKey adds pubkey to root's authorized_keys in the disk of the stopped machine.
+// Like MountDisk, it needs root and the nbd kernel module.
+func (q *QEMU) InjectSSHKey(pubkey string) (err error) {
+	dir, err := q.mountDisk(false)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if uerr := q.UnmountDisk(); uerr != nil && err == nil {
+			err = uerr
+		}
+	}()
+
+	sshDir := filepath.Join(dir, "root", ".ssh")
+	if err := os.MkdirAll(sshDir, 0700); err != nil {
+		return err
+	}
+	if err := os.Chmod(sshDir, 0700); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(filepath.Join(sshDir, "authorized_keys"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := fmt.Fprintln(f, strings.TrimSpace(pubkey)); err != nil {
+		return err
+	}
+	return f.Chmod(0600)
+}
+
+// CheckCleanShutdown verifies that the root filesystem of the stopped machine was
+// cleanly unmounted, that is the guest shut down gracefully without leaving
+// journal entries to recover. Only ext2/3/4 filesystems are supported. Like
+// MountDisk, it needs root and the nbd kernel module.
+func (q *QEMU) CheckCleanShutdown() (err error) {
+	// The filesystem is inspected without mounting it, which would replay the journal
+	dev, err := q.connectNBD(true)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if derr := disconnectNBD(dev); derr != nil && err == nil {
+			err = derr
+		}
+	}()
+
+	part, err := rootPartition(dev)
+	if err != nil {
+		return err
+	}
+
+	fstype, err := utils.SH(fmt.Sprintf("blkid -o value -s TYPE %s", shellQuote(part)))
+	if err != nil {
+		return fmt.Errorf("detecting filesystem of %s: %w - %s", part, err, fstype)
+	}
+	if fstype = strings.TrimSpace(fstype); !strings.HasPrefix(fstype, "ext") {
+		return fmt.Errorf("checking %s filesystems is not supported", fstype)
+	}
+
+	out, err := utils.SH(fmt.Sprintf("dumpe2fs -h %s 2>/dev/null", shellQuote(part)))
+	if err != nil {
+		return fmt.Errorf("reading superblock of %s: %w - %s", part, err, out)
+	}
+	for _, l := range strings.Split(out, "\n") {
+		key, value, ok := strings.Cut(l, ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch key {
+		case "Filesystem state":
+			if value != "clean" {
+				return fmt.Errorf("filesystem of %s was not cleanly unmounted, state: %s", part, value)
+			}
+		case "Filesystem features":
+			if strings.Contains(value, "needs_recovery") {
+				return fmt.Errorf("filesystem of %s has a journal that needs recovery", part)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package machine
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/spectrocloud/peg/pkg/machine/types"
+)
+
+// netemRate matches the rates accepted by tc, e.g. "10mbit" or "1.5gbit".
+var netemRate = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?(bit|kbit|mbit|gbit|tbit|bps|kbps|mbps|gbps|tbps)$`)
+
+// tapName matches valid network interface names.
+var tapName = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,15}$`)
+
+// hasNetem reports whether traffic shaping is configured for n.
+func hasNetem(n types.NIC) bool {
+	return n.Delay != "" || n.Loss != 0 || n.Rate != ""
+}
+
+// nicArgs validates n and returns the qemu options adding it as the i-th
+// additional NIC of a machine with vcpus vCPUs.
+func nicArgs(i int, n types.NIC, vcpus int) ([]string, error) {
+	id := fmt.Sprintf("nic%d", i)
+
+	var netdev string
+	switch n.Mode {
+	case "", "user":
+		if hasNetem(n) {
+			return nil, fmt.Errorf("NIC %d: delay, loss and rate require a tap NIC", i)
+		}
+		netdev = fmt.Sprintf("user,id=%s", id)
+	case "tap":
+		if n.Tap == "" {
+			return nil, fmt.Errorf("NIC %d: tap mode requires the tap interface name", i)
+		}
+		if !tapName.MatchString(n.Tap) {
+			return nil, fmt.Errorf("NIC %d: invalid tap interface name %q", i, n.Tap)
+		}
+		netdev = fmt.Sprintf("tap,id=%s,ifname=%s,script=no,downscript=no", id, n.Tap)
+	default:
+		return nil, fmt.Errorf("NIC %d: invalid mode %q", i, n.Mode)
+	}
+
+	if _, err := netemArgs(n); err != nil {
+		return nil, fmt.Errorf("NIC %d: %w", i, err)
+	}
+
+	model := n.Model
+	if model == "" {
+		model = "virtio-net-pci"
+	}
+	device := fmt.Sprintf("%s,netdev=%s", model, id)
+
+	if n.Vhost || n.Queues != 0 {
+		if n.Mode != "tap" {
+			return nil, fmt.Errorf("NIC %d: vhost and queues require a tap NIC", i)
+		}
+		if !strings.HasPrefix(model, "virtio-net") {
+			return nil, fmt.Errorf("NIC %d: vhost and queues require a virtio-net model, not %s", i, model)
+		}
+	}
+	if n.Vhost {
+		netdev += ",vhost=on"
+	}
+	if n.Queues < 0 || n.Queues > vcpus {
+		return nil, fmt.Errorf("NIC %d: invalid queue count %d, must be between 0 (disabled) and the %d vCPUs", i, n.Queues, vcpus)
+	}
+	if n.Queues > 1 {
+		// One vector per queue for rx and tx, plus config and control
+		netdev += fmt.Sprintf(",queues=%d", n.Queues)
+		device += fmt.Sprintf(",mq=on,vectors=%d", 2*n.Queues+2)
+	}
+	if n.MAC != "" {
+		if _, err := net.ParseMAC(n.MAC); err != nil {
+			return nil, fmt.Errorf("NIC %d: %w", i, err)
+		}
+		device += ",mac=" + n.MAC
+	}
+
+	return []string{"-netdev", netdev, "-device", device}, nil
+}
+
+// netemArgs validates the traffic shaping settings of n and returns them as netem arguments.
+func netemArgs(n types.NIC) (string, error) {
+	var args []string
+	if n.Delay != "" {
+		d, err := time.ParseDuration(n.Delay)
+		if err != nil || d < 0 {
+			return "", fmt.Errorf("invalid delay %q", n.Delay)
+		}
+		args = append(args, fmt.Sprintf("delay %dus", d.Microseconds()))
+	}
+	if n.Loss != 0 {
+		if n.Loss < 0 || n.Loss > 100 {
+			return "", fmt.Errorf("invalid loss %v, must be a percentage", n.Loss)
+		}
+		args = append(args, fmt.Sprintf("loss %v%%", n.Loss))
+	}
+	if n.Rate != "" {
+		if !netemRate.MatchString(n.Rate) {
+			return "", fmt.Errorf("invalid rate %q", n.Rate)
+		}
+		args = append(args, "rate "+n.Rate)
+	}
+	return strings.Join(args, " "), nil
+}
+
+// applyNetem sets up traffic shaping on the tap interfaces of the machine.
+func (q *QEMU) applyNetem() error {
+	for _, n := range q.machineConfig.NICs {
+		if !hasNetem(n) {
+			continue
+		}
+		args, err := netemArgs(n)
+		if err != nil {
+			return err
+		}
+		out, err := q.hostSH(fmt.Sprintf("tc qdisc replace dev %s root netem %s", shellQuote(n.Tap), args))
+		if err != nil {
+			return fmt.Errorf("setting up netem on %s: %w - %s", n.Tap, err, out)
+		}
+	}
+	return nil
+}
+
+// removeNetem removes the traffic shaping set up by applyNetem.
+func (q *QEMU) removeNetem() {
+	for _, n := range q.machineConfig.NICs {
+		if !hasNetem(n) {
+			continue
+		}
+		if out, err := q.hostSH(fmt.Sprintf("tc qdisc del dev %s root", shellQuote(n.Tap))); err != nil {
+			log.Warnf("Failed removing netem from %s: %s - %s", n.Tap, err.Error(), out)
+		}
+	}
+}
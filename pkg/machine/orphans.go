@@ -0,0 +1,177 @@
+package machine
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	process "github.com/mudler/go-processmanager"
+	"github.com/spectrocloud/peg/pkg/machine/types"
+	"gopkg.in/yaml.v3"
+)
+
+// ownerFileName is the file in the state dir recording the pid of the process managing the machine.
+const ownerFileName = "owner"
+
+// OrphanInfo describes a peg state directory left behind by a previous run.
+type OrphanInfo struct {
+	StateDir string
+	// PID is the pid recorded in the state dir, empty if none was recorded.
+	PID string
+	// Alive reports whether the recorded process is still running. Only
+	// machines whose owner is gone are reported while still running.
+	Alive bool
+	// Owner is the pid of the process which created the machine, empty if
+	// none was recorded.
+	Owner string
+}
+
+// recordOwner records the current process as the one managing the machine of stateDir.
+func recordOwner(stateDir string) error {
+	return os.WriteFile(filepath.Join(stateDir, ownerFileName), []byte(strconv.Itoa(os.Getpid())), 0600)
+}
+
+// pidExists reports whether a process with the given pid exists.
+func pidExists(pid string) bool {
+	n, err := strconv.Atoi(pid)
+	if err != nil || n <= 0 {
+		return false
+	}
+	p, err := os.FindProcess(n)
+	if err != nil {
+		return false
+	}
+	err = p.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// isStateDir reports whether dir looks like a state dir created by a QEMU machine.
+func isStateDir(dir string) bool {
+	for _, f := range []string{machineConfigName, monitorSockName, "pid"} {
+		if _, err := os.Stat(filepath.Join(dir, f)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// recordedName returns the name of the machine recorded in dir, if any.
+func recordedName(dir string) string {
+	dat, err := os.ReadFile(filepath.Join(dir, machineConfigName))
+	if err != nil {
+		return ""
+	}
+	mc := types.MachineConfig{}
+	if err := yaml.Unmarshal(dat, &mc); err != nil {
+		return ""
+	}
+	return (&QEMU{machineConfig: mc}).name()
+}
+
+// processHasName reports whether the process pid was started with name as -name.
+func processHasName(pid, name string) bool {
+	cmdline, err := os.ReadFile(filepath.Join("/proc", pid, "cmdline"))
+	if err != nil {
+		// Can't tell, e.g. not on Linux
+		return true
+	}
+	return strings.Contains(string(cmdline), "guest="+strings.ReplaceAll(name, ",", ",,")+",")
+}
+
+// FindOrphans scans baseDir for state dirs created by peg that are not tracked by
+// the current process and are stale: either their recorded process is dead, or
+// it still runs but the process which created it is gone. Machines still
+// running without a recorded owner are not reported, as they might belong to
+// another test process sharing baseDir.
+func FindOrphans(baseDir string) ([]OrphanInfo, error) {
+	entries, err := os.ReadDir(baseDir)
+	if err != nil {
+		return nil, err
+	}
+
+	tracked := map[string]bool{}
+	registryLock.Lock()
+	for _, m := range registry {
+		tracked[filepath.Clean(m.Config().StateDir)] = true
+	}
+	registryLock.Unlock()
+
+	orphans := []OrphanInfo{}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		dir := filepath.Join(baseDir, e.Name())
+		if tracked[filepath.Clean(dir)] || !isStateDir(dir) {
+			continue
+		}
+
+		p := process.New(process.WithStateDir(dir))
+		pid, _ := os.ReadFile(filepath.Join(dir, "pid"))
+		o := OrphanInfo{
+			StateDir: dir,
+			PID:      strings.TrimSpace(string(pid)),
+			Alive:    p.IsAlive(),
+		}
+		// The pid might have been reused by another process since, check it's the same machine
+		if o.Alive {
+			if name := recordedName(dir); name != "" && !processHasName(o.PID, name) {
+				o.Alive = false
+			}
+		}
+		if owner, err := os.ReadFile(filepath.Join(dir, ownerFileName)); err == nil {
+			o.Owner = strings.TrimSpace(string(owner))
+		}
+		// A running machine is only leaked if its owner is known to be gone
+		if o.Alive && (o.Owner == "" || pidExists(o.Owner)) {
+			continue
+		}
+		orphans = append(orphans, o)
+	}
+
+	return orphans, nil
+}
+
+// ReapOrphans removes the state dirs found by FindOrphans in baseDir whose
+// process is dead. Running machines are left alone, see ReapLeakedOrphans.
+func ReapOrphans(baseDir string) error {
+	return reapOrphans(baseDir, false)
+}
+
+// ReapLeakedOrphans is like ReapOrphans, but also kills the machines still
+// running whose owner process is gone.
+func ReapLeakedOrphans(baseDir string) error {
+	return reapOrphans(baseDir, true)
+}
+
+func reapOrphans(baseDir string, killLeaked bool) error {
+	orphans, err := FindOrphans(baseDir)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, o := range orphans {
+		if o.Alive {
+			if !killLeaked {
+				log.Infof("Skipping orphaned state dir %s, its process %s is still running", o.StateDir, o.PID)
+				continue
+			}
+			log.Infof("Killing orphaned process %s from %s", o.PID, o.StateDir)
+			if err := process.New(process.WithStateDir(o.StateDir)).Stop(); err != nil {
+				errs = append(errs, fmt.Errorf("stopping process %s: %w", o.PID, err))
+				continue
+			}
+		}
+		log.Infof("Removing orphaned state dir %s", o.StateDir)
+		if err := os.RemoveAll(o.StateDir); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -1,13 +1,18 @@
 package machine
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"os"
 	"os/exec"
-	"path"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"context"
@@ -16,11 +21,115 @@ import (
 	"github.com/spectrocloud/peg/internal/utils"
 	"github.com/spectrocloud/peg/pkg/controller"
 	"github.com/spectrocloud/peg/pkg/machine/types"
+	"golang.org/x/crypto/ssh"
 )
 
+// archSettings holds the qemu defaults that differ between guest architectures.
+type archSettings struct {
+	// cpu is the default -cpu model, used when no CPUType is set
+	cpu string
+	// machine is the -machine type
+	machine string
+	// bios is the firmware passed with -bios
+	bios string
+}
+
+// archDefaults maps the Arch of the machine config to its qemu defaults.
+// The arch also selects the qemu-system-<arch> binary.
+var archDefaults = map[string]archSettings{
+	"x86_64":  {},
+	"aarch64": {cpu: "max", machine: "virt,accel=tcg,acpi=on,gic-version=2"},
+	// "default" is the OpenSBI firmware shipped with qemu
+	"riscv64": {machine: "virt", bios: "default"},
+}
+
 type QEMU struct {
 	machineConfig types.MachineConfig
 	process       *process.Process
+
+	// set by Stop, so that OnFailure is not called when the process is killed
+	stopping atomic.Bool
+
+	// cached by Version
+	versionLock sync.Mutex
+	version     string
+
+	// connection shared by monitor commands, see monitorCommand
+	monitorLock sync.Mutex
+	monitorConn net.Conn
+
+	// serializes the guest agent requests
+	agentLock sync.Mutex
+
+	// set while the disk is mounted on the host, see MountDisk
+	nbdDevice  string
+	mountPoint string
+
+	// connection to the RemoteHost shared by the host commands, see hostClient
+	remoteLock sync.Mutex
+	remote     *ssh.Client
+
+	// serializes the QMP sessions, see dialQMP
+	qmpLock sync.Mutex
+
+	// -incoming address of a migration destination, see MigrateTo
+	incoming string
+
+	// disks the machine was launched with, shared with the destination by MigrateTo
+	drives []types.DriveConfig
+
+	// set by Restart, so that existing disks are not created again
+	reuseDisks bool
+}
+
+// maxParallelDiskCreation bounds how many disks are created at the same time.
+const maxParallelDiskCreation = 4
+
+// createDisks creates a disk in the state dir for each of sizes, in parallel,
+// and returns their file names.
+func (q *QEMU) createDisks(sizes []string) ([]string, error) {
+	filenames := make([]string, len(sizes))
+	errs := make([]error, len(sizes))
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, maxParallelDiskCreation)
+	for i, s := range sizes {
+		filenames[i] = fmt.Sprintf("%s-%d.img", q.machineConfig.ID, i)
+		if q.reuseDisks && q.hasStateFile(filenames[i]) {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, s string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			if err := q.CreateDisk(filenames[i], s); err != nil {
+				errs[i] = fmt.Errorf("creating disk %s with size %s: %w", filenames[i], s, err)
+			}
+		}(i, s)
+	}
+	wg.Wait()
+
+	return filenames, errors.Join(errs...)
+}
+
+// binary returns the qemu binary used to run the machine.
+func (q *QEMU) binary() (string, error) {
+	if q.machineConfig.Process != "" {
+		return q.machineConfig.Process, nil
+	}
+
+	var bin string
+	var err error
+	if q.machineConfig.RemoteHost != nil {
+		bin, err = q.hostLookPath(fmt.Sprintf("qemu-system-%s", q.machineConfig.Arch))
+	} else {
+		bin, err = findQEMUBinary(q.machineConfig.Arch)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to find QEMU binary: %w", err)
+	}
+	return bin, nil
 }
 
 // findQEMUBinary searches for qemu-system-x86_64 in common installation paths
@@ -51,20 +160,110 @@ func findQEMUBinary(arch string) (string, error) {
 	return path, nil
 }
 
+// errTransientLaunch marks qemu launch failures that are worth retrying.
+var errTransientLaunch = errors.New("transient qemu launch failure")
+
+// transientLaunchErrors are messages printed by qemu when it fails to start
+// because of a resource that might be available on a later attempt.
+var transientLaunchErrors = []string{
+	"Address already in use",
+	"Could not set up host forwarding rule",
+	"Device or resource busy",
+	"Resource temporarily unavailable",
+	"failed to initialize kvm",
+}
+
+// ErrPermissionDenied is returned by Create when qemu fails to start because it
+// was denied access to a file, often because of AppArmor or SELinux policies.
+var ErrPermissionDenied = errors.New("qemu was denied access to a file")
+
+// ErrSandbox is returned by Create when qemu rejects the sandbox options,
+// e.g. because it was built without seccomp support.
+var ErrSandbox = errors.New("qemu failed to set up the sandbox")
+
+// confinementHint returns a suggestion on how to debug permission denied
+// failures, depending on the security modules enabled on the host.
+func confinementHint() string {
+	if b, err := os.ReadFile("/sys/fs/selinux/enforce"); err == nil && strings.TrimSpace(string(b)) == "1" {
+		return "SELinux is enforcing, check the denials with 'ausearch -m avc' and consider setting TempDir to a location with a qemu friendly context"
+	}
+	if b, err := os.ReadFile("/sys/module/apparmor/parameters/enabled"); err == nil && strings.TrimSpace(string(b)) == "Y" {
+		return "AppArmor is enabled, check the denials in the kernel log and consider setting TempDir to a location allowed by the qemu profile"
+	}
+	return "check the permissions of the disks, ISOs and state dir"
+}
+
 func (q *QEMU) Create(ctx context.Context) (context.Context, error) {
 	log.Info("Create qemu machine")
+	register(q)
 
-	driveSizes := q.driveSizes()
-	userDrives := q.machineConfig.Drives
+	for attempt := 0; ; attempt++ {
+		// Only the launch is throttled, not PostCreate nor the backoff
+		release, err := acquireCreate(ctx)
+		if err != nil {
+			return ctx, err
+		}
+		newCtx, err := q.launch(ctx)
+		release()
+		if err == nil {
+			return newCtx, failed(q.machineConfig, postCreate(q))
+		}
+		if attempt >= q.machineConfig.CreateRetries || !errors.Is(err, errTransientLaunch) {
+			return newCtx, failed(q.machineConfig, err)
+		}
+
+		backoff := time.Duration(1<<attempt) * 2 * time.Second
+		log.Warnf("Failed creating qemu machine (attempt %d of %d), retrying in %s: %s", attempt+1, q.machineConfig.CreateRetries+1, backoff, err.Error())
+		_ = q.stop()
+		time.Sleep(backoff)
+	}
+}
+
+// launch creates the disks and starts the qemu process.
+func (q *QEMU) launch(ctx context.Context) (context.Context, error) {
+	driveSizes, err := q.driveSizes()
+	if err != nil {
+		return ctx, err
+	}
+	userDrives := []types.DriveConfig{}
+	for _, d := range q.machineConfig.Drives {
+		userDrives = append(userDrives, types.DriveConfig{Path: d})
+	}
+	userDrives = append(userDrives, q.machineConfig.Disks...)
 	if q.machineConfig.AutoDriveSetup && len(userDrives) == 0 {
-		for i, s := range driveSizes {
-			filename := fmt.Sprintf("%s-%d.img", q.machineConfig.ID, i)
-			err := q.CreateDisk(filename, s)
-			if err != nil {
-				return ctx, fmt.Errorf("creating disk with size %s: %w", s, err)
-			}
-			userDrives = append(userDrives, filepath.Join(q.machineConfig.StateDir, filename))
+		filenames, err := q.createDisks(driveSizes)
+		if err != nil {
+			return ctx, err
+		}
+		for _, f := range filenames {
+			userDrives = append(userDrives, types.DriveConfig{Path: filepath.Join(q.machineConfig.StateDir, f)})
+		}
+	}
+	q.drives = userDrives
+
+	// Check the disk interfaces, find the host block devices, and hand the
+	// passphrases of encrypted disks to qemu in files, to keep them out of the
+	// command line
+	secrets := map[int]string{}
+	blockDevices := map[int]bool{}
+	for i, d := range userDrives {
+		switch d.Interface {
+		case "", "virtio", "scsi", "nvme", "ide":
+		default:
+			return ctx, fmt.Errorf("invalid interface %q for disk %s", d.Interface, d.Path)
+		}
+		blockDevices[i] = q.isBlockDevice(d.Path)
+		if blockDevices[i] && d.Encryption != nil {
+			return ctx, fmt.Errorf("disk %s: encryption is not supported on block devices", d.Path)
+		}
+		if d.Encryption == nil {
+			continue
+		}
+		f, err := q.writeSecret(fmt.Sprintf("drv%d", i), d.Encryption.Passphrase)
+		if err != nil {
+			return ctx, err
 		}
+		secrets[i] = f
 	}
 
 	genDrives := func(m types.MachineConfig) []string {
@@ -72,18 +271,7 @@ func (q *QEMU) Create(ctx context.Context) (context.Context, error) {
 		scsiAdded := false
 		id := 0
 
-		// User disks: bootindex 1..N (highest priority)
-		for i, d := range userDrives {
-			driveID := fmt.Sprintf("drv%d", id)
-			id++
-
-			allDrives = append(allDrives,
-				"-drive", fmt.Sprintf("if=none,id=%s,file=%s", driveID, d),
-				"-device", fmt.Sprintf("virtio-blk-pci,drive=%s,bootindex=%d", driveID, i+1),
-			)
-		}
-
-		// If we have any CDROMs we want them as /dev/srX => add a virtio-scsi controller once
+		// If we have any CDROMs or scsi disks, add a virtio-scsi controller once
 		addSCSIIfNeeded := func() {
 			if !scsiAdded {
 				// create a virtio SCSI controller
@@ -94,6 +282,46 @@ func (q *QEMU) Create(ctx context.Context) (context.Context, error) {
 			}
 		}
 
+		// User disks: bootindex 1..N (highest priority), unless set explicitly
+		for i, d := range userDrives {
+			driveID := fmt.Sprintf("drv%d", id)
+			id++
+
+			bootIndex := i + 1
+			if d.BootIndex != 0 {
+				bootIndex = d.BootIndex
+			}
+
+			drive := fmt.Sprintf("if=none,id=%s,file=%s", driveID, d.Path)
+			if blockDevices[i] {
+				// Bypass the host page cache, the device is used directly
+				drive += ",format=raw,cache=none"
+			}
+			if secret, ok := secrets[i]; ok {
+				allDrives = append(allDrives, "-object", fmt.Sprintf("secret,id=%s-secret,file=%s", driveID, secret))
+				drive += fmt.Sprintf(",encrypt.key-secret=%s-secret", driveID)
+			}
+
+			var device string
+			switch d.Interface {
+			case "scsi":
+				addSCSIIfNeeded()
+				device = fmt.Sprintf("scsi-hd,drive=%s,bus=scsi0.0,bootindex=%d", driveID, bootIndex)
+			case "nvme":
+				// Each disk gets its own nvme controller, which requires a serial
+				device = fmt.Sprintf("nvme,drive=%[1]s,serial=%[1]s,bootindex=%[2]d", driveID, bootIndex)
+			case "ide":
+				device = fmt.Sprintf("ide-hd,drive=%s,bootindex=%d", driveID, bootIndex)
+			default:
+				device = fmt.Sprintf("virtio-blk-pci,drive=%s,bootindex=%d", driveID, bootIndex)
+			}
+
+			allDrives = append(allDrives,
+				"-drive", drive,
+				"-device", device,
+			)
+		}
+
 		// Primary ISO -> appear as /dev/srX (scsi-cd)
 		if m.ISO != "" {
 			addSCSIIfNeeded()
@@ -121,20 +349,14 @@ func (q *QEMU) Create(ctx context.Context) (context.Context, error) {
 		return allDrives
 	}
 
-	var processName string
-	if q.machineConfig.Process != "" {
-		processName = q.machineConfig.Process
-	} else {
-		var err error
-		processName, err = findQEMUBinary(q.machineConfig.Arch)
-		if err != nil {
-			return ctx, fmt.Errorf("failed to find QEMU binary: %w", err)
-		}
+	processName, err := q.binary()
+	if err != nil {
+		return ctx, err
 	}
 
 	log.Infof("Starting VM with %s [ Memory: %s, CPU: %s ]", processName, q.machineConfig.Memory, q.machineConfig.CPU)
 	for _, d := range userDrives {
-		log.Infof("HD at %s, state directory at %s", d, q.machineConfig.StateDir)
+		log.Infof("HD at %s, state directory at %s", d.Path, q.machineConfig.StateDir)
 	}
 	if q.machineConfig.ISO != "" {
 		log.Infof("ISO at %s", q.machineConfig.ISO)
@@ -149,36 +371,161 @@ func (q *QEMU) Create(ctx context.Context) (context.Context, error) {
 		display = q.machineConfig.Display
 	}
 
+	rtcBase, rtcClock := "utc", "rt"
+	if q.machineConfig.RTCBase != "" {
+		rtcBase = q.machineConfig.RTCBase
+	}
+	if q.machineConfig.RTCClock != "" {
+		rtcClock = q.machineConfig.RTCClock
+	}
+
+	smp, err := smpArg(q.machineConfig)
+	if err != nil {
+		return ctx, err
+	}
+
+	mem, err := memoryMiB(q.machineConfig)
+	if err != nil {
+		return ctx, err
+	}
+
 	// Enable qemu monitor to enable screendump (used in `Screenshot()`):
 	opts := []string{
-		"-m", q.machineConfig.Memory,
-		"-smp", fmt.Sprintf("cores=%s", q.machineConfig.CPU),
-		"-rtc", "base=utc,clock=rt",
-		"-monitor", fmt.Sprintf("unix:%s,server,nowait", q.monitorSockFile()),
-		"-device", "virtio-serial",
+		"-name", q.nameArg(),
+		"-m", fmt.Sprintf("%dM", mem),
+		"-smp", smp,
+		"-rtc", fmt.Sprintf("base=%s,clock=%s", rtcBase, rtcClock),
+	}
+	monitorOpts, err := q.monitorOpts()
+	if err != nil {
+		return ctx, err
+	}
+	opts = append(opts, monitorOpts...)
+	opts = append(opts, q.qmpOpts()...)
+	if q.incoming != "" {
+		opts = append(opts, "-incoming", q.incoming)
+	}
+	serialOpts, err := q.virtioSerialOpts()
+	if err != nil {
+		return ctx, err
+	}
+	opts = append(opts, serialOpts...)
+
+	memOpts, err := q.memoryOpts()
+	if err != nil {
+		return ctx, err
+	}
+	opts = append(opts, memOpts...)
+
+	if q.machineConfig.Sandbox != nil {
+		sandbox, err := sandboxArg(*q.machineConfig.Sandbox)
+		if err != nil {
+			return ctx, err
+		}
+		opts = append(opts, "-sandbox", sandbox)
+	}
+
+	actionOpts, err := q.actionOpts()
+	if err != nil {
+		return ctx, err
+	}
+	opts = append(opts, actionOpts...)
+
+	uuid, err := q.uuid()
+	if err != nil {
+		return ctx, err
+	}
+	if uuid != "" {
+		opts = append(opts, "-uuid", uuid)
 	}
 
 	// Add default networking unless disabled
 	if !q.machineConfig.DisableDefaultNetworking {
-		opts = append(opts, "-nic", fmt.Sprintf("user,hostfwd=tcp::%s-:22", q.machineConfig.SSH.Port))
+		nic := fmt.Sprintf("user,hostfwd=tcp::%s-:22", q.machineConfig.SSH.Port)
+		if q.machineConfig.Seed != "" {
+			nic += ",mac=" + seededMAC(q.machineConfig.Seed, 0)
+		}
+		opts = append(opts, "-nic", nic)
+	}
+
+	for i, n := range q.machineConfig.NICs {
+		if n.MAC == "" && q.machineConfig.Seed != "" {
+			n.MAC = seededMAC(q.machineConfig.Seed, i+1)
+		}
+		vcpus, err := vcpuCount(q.machineConfig)
+		if err != nil {
+			return ctx, err
+		}
+		nicOpts, err := nicArgs(i, n, vcpus)
+		if err != nil {
+			return ctx, err
+		}
+		opts = append(opts, nicOpts...)
 	}
 
 	opts = append(opts, strings.Split(display, " ")...)
 
+	if q.machineConfig.SerialLogFile != "" {
+		serialOpts, err := q.serialLogOpts()
+		if err != nil {
+			return ctx, err
+		}
+		opts = append(opts, serialOpts...)
+	}
+
+	vgaOpts, err := q.vgaOpts()
+	if err != nil {
+		return ctx, err
+	}
+	opts = append(opts, vgaOpts...)
+
+	arch := archDefaults[q.machineConfig.Arch]
+
 	if q.machineConfig.CPUType != "" {
 		opts = append(opts, "-cpu", q.machineConfig.CPUType)
-	} else if q.machineConfig.Arch == "aarch64" {
-		// For aarch64, set a default CPU type if not specified
-		opts = append(opts, "-cpu", "max")
+	} else if arch.cpu != "" {
+		opts = append(opts, "-cpu", arch.cpu)
+	}
+
+	if q.machineConfig.Hostname != "" {
+		// https://www.freedesktop.org/software/systemd/man/latest/systemd.system-credentials.html
+		opts = append(opts, "-smbios", fmt.Sprintf("type=11,value=io.systemd.credential:system.hostname=%s", q.machineConfig.Hostname))
+	}
+
+	for _, f := range q.machineConfig.FwCfg {
+		arg, err := fwCfgArg(f)
+		if err != nil {
+			return ctx, err
+		}
+		opts = append(opts, "-fw_cfg", arg)
+	}
+
+	for _, addr := range q.machineConfig.PCIPassthrough {
+		// Devices of a remote host can't be checked from here
+		if q.machineConfig.RemoteHost == nil {
+			addr, err = vfioDevice(addr)
+			if err != nil {
+				return ctx, err
+			}
+		}
+		opts = append(opts, "-device", fmt.Sprintf("vfio-pci,host=%s", addr))
+	}
+
+	for _, d := range q.machineConfig.Devices {
+		arg, err := deviceArg(d)
+		if err != nil {
+			return ctx, err
+		}
+		opts = append(opts, "-device", arg)
 	}
 
 	opts = append(opts, q.machineConfig.Args...)
 
-	if q.machineConfig.Arch == "aarch64" {
-		// For aarch64, we need to specify machine type and firmware
-		opts = append(opts,
-			"-machine", "virt,accel=tcg,acpi=on,gic-version=2",
-		)
+	if arch.machine != "" {
+		opts = append(opts, "-machine", arch.machine)
+	}
+	if arch.bios != "" {
+		opts = append(opts, "-bios", arch.bios)
 	}
 
 	// Use QEMU boot order "dc" (disk, then cdrom). This works in conjunction with
@@ -188,94 +535,510 @@ func (q *QEMU) Create(ctx context.Context) (context.Context, error) {
 	// the same type.
 	opts = append(opts, "-boot", "order=dc,menu=on")
 
+	if len(q.machineConfig.CPUPin) > 0 {
+		// Run qemu through taskset so that all of its threads, vCPUs included,
+		// are scheduled only on the given host CPUs
+		taskset, err := q.hostLookPath("taskset")
+		if err != nil {
+			return ctx, fmt.Errorf("taskset is required for CPU pinning: %w", err)
+		}
+		cpus := []string{}
+		for _, c := range q.machineConfig.CPUPin {
+			if c < 0 {
+				return ctx, fmt.Errorf("invalid host CPU to pin: %d", c)
+			}
+			cpus = append(cpus, fmt.Sprint(c))
+		}
+		opts = append([]string{"-c", strings.Join(cpus, ","), processName}, opts...)
+		processName = taskset
+	}
+
 	log.Infof("Creating QEMU machine with args: %s", strings.Join(append(opts, genDrives(q.machineConfig)...), " "))
 
-	qemu := process.New(
-		process.WithName(processName),
-		process.WithArgs(opts...),
-		process.WithArgs(genDrives(q.machineConfig)...),
-		process.WithStateDir(q.machineConfig.StateDir),
-	)
+	// Record the config to allow attaching to the machine later on
+	if q.machineConfig.RemoteHost == nil {
+		if err := saveConfig(q.machineConfig); err != nil {
+			return ctx, fmt.Errorf("saving machine config: %w", err)
+		}
+		if err := recordOwner(q.machineConfig.StateDir); err != nil {
+			return ctx, fmt.Errorf("recording machine owner: %w", err)
+		}
+	}
 
-	q.process = qemu
+	var p processHandle
+	var stderrOffset int64
+	if q.machineConfig.RemoteHost != nil {
+		if err := q.launchRemote(processName, append(opts, genDrives(q.machineConfig)...)); err != nil {
+			return ctx, err
+		}
+		p = remoteProcess{q: q}
+	} else {
+		qemu := process.New(
+			process.WithName(processName),
+			process.WithArgs(opts...),
+			process.WithArgs(genDrives(q.machineConfig)...),
+			process.WithStateDir(q.machineConfig.StateDir),
+		)
 
-	newCtx := monitor(ctx, qemu, q.machineConfig.OnFailure)
-	return newCtx, qemu.Run()
+		q.process = qemu
+
+		if fi, err := os.Stat(qemu.StderrPath()); err == nil {
+			stderrOffset = fi.Size()
+		}
+
+		if err := qemu.Run(); err != nil {
+			return ctx, err
+		}
+		p = qemu
+	}
+
+	// Make sure qemu didn't bail out right away
+	if err := q.checkLaunch(stderrOffset); err != nil {
+		return ctx, err
+	}
+
+	if err := q.applyNetem(); err != nil {
+		// qemu is already running, don't leak it
+		_ = q.stop()
+		return ctx, err
+	}
+
+	if err := q.applyCgroup(); err != nil {
+		// qemu is already running, don't leak it
+		_ = q.stop()
+		_ = q.removeCgroup()
+		return ctx, err
+	}
+	q.machineConfig.Emit(types.EventProcessStarted, processName)
+
+	q.stopping.Store(false)
+	newCtx := monitor(ctx, p, func() {
+		if q.stopping.Load() {
+			return
+		}
+		q.machineConfig.Emit(types.EventFailed, "qemu exited unexpectedly")
+		if q.machineConfig.OnFailure != nil {
+			q.machineConfig.OnFailure(q)
+		}
+	})
+	if q.machineConfig.SerialLogFile != "" && q.machineConfig.SerialLogMaxBytes > 0 {
+		go q.capSerialLog(newCtx)
+	}
+	return newCtx, nil
 }
 
-func (q *QEMU) Config() types.MachineConfig {
-	return q.machineConfig
+// launchSettleTimeout bounds how long checkLaunch waits for qemu to be up.
+const launchSettleTimeout = 3 * time.Second
+
+// checkLaunch waits for the qemu process to settle, and returns its error
+// output if it exited, wrapping ErrProcessExited. Failures due to busy resources wrap errTransientLaunch,
+// failures to access files wrap ErrPermissionDenied and failures to set up
+// the sandbox wrap ErrSandbox. It returns as soon as the monitor answers,
+// which qemu does once it's done setting up the machine.
+func (q *QEMU) checkLaunch(stderrOffset int64) error {
+	deadline := time.Now().Add(launchSettleTimeout)
+	for {
+		time.Sleep(100 * time.Millisecond)
+		if !q.Alive() {
+			return q.launchError(stderrOffset)
+		}
+		if time.Now().After(deadline) || q.monitorReady(deadline) {
+			return nil
+		}
+	}
 }
 
-// qemu monitor: https://qemu-project.gitlab.io/qemu/system/monitor.html
-// nice explanation of how it works: https://unix.stackexchange.com/a/476617
-// unix sockets with golang: https://dev.to/douglasmakey/understanding-unix-domain-sockets-in-golang-32n8
-func (q *QEMU) Screenshot() (string, error) {
-	conn, err := net.Dial("unix", q.monitorSockFile())
+// monitorReady reports whether the monitor of the local machine prints its
+// banner before deadline.
+func (q *QEMU) monitorReady(deadline time.Time) bool {
+	if q.machineConfig.RemoteHost != nil {
+		return false
+	}
+	conn, err := q.dialMonitor()
 	if err != nil {
-		return "", err
+		return false
 	}
 	defer conn.Close()
+	if err := conn.SetReadDeadline(deadline); err != nil {
+		return false
+	}
+	n, _ := conn.Read(make([]byte, 1))
+	return n > 0
+}
 
-	// Create a temp file name
-	f, err := os.CreateTemp("", "qemu-screenshot-*.png")
+// launchError returns the error of a qemu process which exited right after starting.
+func (q *QEMU) launchError(stderrOffset int64) error {
+	out := ""
+	if b, err := q.readStateFile("stderr"); err == nil && int64(len(b)) >= stderrOffset {
+		out = strings.TrimSpace(string(b[stderrOffset:]))
+	}
+	for _, e := range transientLaunchErrors {
+		if strings.Contains(out, e) {
+			return withKind(ErrProcessExited, fmt.Errorf("%w: %s", errTransientLaunch, out))
+		}
+	}
+	if strings.Contains(out, "Permission denied") {
+		return withKind(ErrProcessExited, fmt.Errorf("%w (%s): %s", ErrPermissionDenied, confinementHint(), out))
+	}
+	if q.machineConfig.Sandbox != nil && (strings.Contains(out, "sandbox") || strings.Contains(out, "seccomp")) {
+		return withKind(ErrProcessExited, fmt.Errorf("%w: %s", ErrSandbox, out))
+	}
+	return withKind(ErrProcessExited, fmt.Errorf("qemu exited right after starting: %s", out))
+}
+
+// actionOpts returns the qemu options setting how reboots and panics of the guest are handled.
+func (q *QEMU) actionOpts() ([]string, error) {
+	var opts, actions []string
+	if q.machineConfig.NoReboot {
+		opts = append(opts, "-no-reboot")
+		actions = append(actions, "reboot=shutdown")
+	}
+
+	if q.machineConfig.NoReboot || q.machineConfig.PanicAction != "" {
+		if err := q.requireVersion("-action", 6, 0); err != nil {
+			return nil, err
+		}
+	}
+
+	switch q.machineConfig.PanicAction {
+	case "":
+	case "pause", "shutdown", "exit-failure", "none":
+		actions = append(actions, "panic="+q.machineConfig.PanicAction)
+		// pvpanic lets the guest report its panics to qemu
+		if q.machineConfig.Arch == "x86_64" {
+			opts = append(opts, "-device", "pvpanic")
+		} else {
+			opts = append(opts, "-device", "pvpanic-pci")
+		}
+	default:
+		return nil, fmt.Errorf("invalid panic action %q", q.machineConfig.PanicAction)
+	}
+
+	if len(actions) > 0 {
+		opts = append(opts, "-action", strings.Join(actions, ","))
+	}
+	return opts, nil
+}
+
+// name returns the name identifying the machine.
+func (q *QEMU) name() string {
+	if q.machineConfig.Name != "" {
+		return q.machineConfig.Name
+	}
+	return q.machineConfig.ID
+}
+
+// nameArg returns the -name value, which also sets the name of the qemu process.
+func (q *QEMU) nameArg() string {
+	name := strings.ReplaceAll(q.name(), ",", ",,")
+	return fmt.Sprintf("guest=%s,process=%s", name, name)
+}
+
+// isBlockDevice reports whether path is a block device, e.g. a disk or LVM
+// volume, on the host running qemu.
+func (q *QEMU) isBlockDevice(path string) bool {
+	if q.machineConfig.RemoteHost != nil {
+		_, err := q.hostSH(fmt.Sprintf("test -b %s", shellQuote(path)))
+		return err == nil
+	}
+	fi, err := os.Stat(path)
+	return err == nil && fi.Mode()&os.ModeDevice != 0 && fi.Mode()&os.ModeCharDevice == 0
+}
+
+// sandboxArg validates s and returns the matching -sandbox value.
+func sandboxArg(s types.Sandbox) (string, error) {
+	knobs := []struct{ name, value string }{
+		{"obsolete", s.Obsolete},
+		{"elevateprivileges", s.ElevatePrivileges},
+		{"spawn", s.Spawn},
+		{"resourcecontrol", s.ResourceControl},
+	}
+
+	arg := "on"
+	for _, k := range knobs {
+		switch k.value {
+		case "":
+			k.value = "deny"
+		case "allow", "deny":
+		default:
+			return "", fmt.Errorf("invalid sandbox %s value %q, must be allow or deny", k.name, k.value)
+		}
+		arg += fmt.Sprintf(",%s=%s", k.name, k.value)
+	}
+	return arg, nil
+}
+
+// vcpuCount returns the number of vCPUs of the machine.
+func vcpuCount(mc types.MachineConfig) (int, error) {
+	sockets, cores, threads, err := cpuTopology(mc)
 	if err != nil {
-		return "", err
+		return 0, err
 	}
-	f.Close()
-	os.Remove(f.Name())
+	return sockets * cores * threads, nil
+}
 
-	cmd := fmt.Sprintf("screendump %s\r\n", f.Name())
-	n, err := fmt.Fprint(conn, cmd)
+// cpuTopology returns the sockets, cores per socket and threads per core of
+// mc. When CPUCores is not set, CPU is split between the sockets and threads,
+// otherwise CPU must match the topology if set.
+func cpuTopology(mc types.MachineConfig) (int, int, int, error) {
+	sockets, threads := max(mc.CPUSockets, 1), max(mc.CPUThreads, 1)
+	if mc.CPUCores != 0 {
+		total := sockets * mc.CPUCores * threads
+		if mc.CPU != "" && mc.CPU != strconv.Itoa(total) {
+			return 0, 0, 0, fmt.Errorf("CPU count %q doesn't match the topology of %d sockets with %d cores and %d threads (%d vCPUs)", mc.CPU, sockets, mc.CPUCores, threads, total)
+		}
+		return sockets, mc.CPUCores, threads, nil
+	}
+
+	total, err := strconv.Atoi(mc.CPU)
+	if err != nil || total <= 0 {
+		return 0, 0, 0, fmt.Errorf("invalid CPU count %q", mc.CPU)
+	}
+	if total%(sockets*threads) != 0 {
+		return 0, 0, 0, fmt.Errorf("%d CPUs can't be split in %d sockets with %d threads per core", total, sockets, threads)
+	}
+	return sockets, total / (sockets * threads), threads, nil
+}
+
+// smpArg returns the -smp value for the CPU configuration of mc.
+func smpArg(mc types.MachineConfig) (string, error) {
+	if mc.CPUSockets == 0 && mc.CPUCores == 0 && mc.CPUThreads == 0 {
+		return fmt.Sprintf("cores=%s", mc.CPU), nil
+	}
+
+	sockets, cores, threads, err := cpuTopology(mc)
 	if err != nil {
 		return "", err
 	}
+	return fmt.Sprintf("%d,sockets=%d,cores=%d,threads=%d", sockets*cores*threads, sockets, cores, threads), nil
+}
+
+// fwCfgArg validates a fw_cfg entry and returns the matching -fw_cfg value.
+func fwCfgArg(f types.FwCfg) (string, error) {
+	// https://www.qemu.org/docs/master/specs/fw_cfg.html
+	if !strings.HasPrefix(f.Name, "opt/") {
+		return "", fmt.Errorf("invalid fw_cfg name %q: must start with \"opt/\"", f.Name)
+	}
+	if len(f.Name) > 55 {
+		return "", fmt.Errorf("invalid fw_cfg name %q: longer than 55 characters", f.Name)
+	}
+	if strings.Contains(f.Name, ",") {
+		return "", fmt.Errorf("invalid fw_cfg name %q: must not contain commas", f.Name)
+	}
+
+	switch {
+	case f.File != "" && f.String != "":
+		return "", fmt.Errorf("fw_cfg %s: only one of file or string can be set", f.Name)
+	case f.File != "":
+		if _, err := os.Stat(f.File); err != nil {
+			return "", fmt.Errorf("fw_cfg %s: %w", f.Name, err)
+		}
+		return fmt.Sprintf("name=%s,file=%s", f.Name, strings.ReplaceAll(f.File, ",", ",,")), nil
+	case f.String != "":
+		return fmt.Sprintf("name=%s,string=%s", f.Name, strings.ReplaceAll(f.String, ",", ",,")), nil
+	}
+
+	return "", fmt.Errorf("fw_cfg %s: one of file or string must be set", f.Name)
+}
+
+// deviceArg validates d and returns the matching -device value.
+func deviceArg(d types.DeviceSpec) (string, error) {
+	if d.Driver == "" || strings.ContainsAny(d.Driver, ",= ") {
+		return "", fmt.Errorf("invalid device driver %q", d.Driver)
+	}
+
+	// Sorted, so that the command line is stable
+	keys := make([]string, 0, len(d.Properties))
+	for k := range d.Properties {
+		if k == "" || strings.ContainsAny(k, ",= ") {
+			return "", fmt.Errorf("device %s: invalid property name %q", d.Driver, k)
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	arg := d.Driver
+	for _, k := range keys {
+		arg += fmt.Sprintf(",%s=%s", k, strings.ReplaceAll(d.Properties[k], ",", ",,"))
+	}
+	return arg, nil
+}
+
+// vfioDevice normalizes a host PCI address and checks it's ready to be passed through.
+func vfioDevice(addr string) (string, error) {
+	// Addresses without the PCI domain are in the first one
+	if strings.Count(addr, ":") == 1 {
+		addr = "0000:" + addr
+	}
+
+	dev := filepath.Join("/sys/bus/pci/devices", addr)
+	if _, err := os.Stat(dev); err != nil {
+		return "", fmt.Errorf("PCI device %s not found: %w", addr, err)
+	}
+
+	driver, err := os.Readlink(filepath.Join(dev, "driver"))
+	if err != nil {
+		return "", fmt.Errorf("PCI device %s is not bound to any driver, it must be bound to vfio-pci", addr)
+	}
+	if filepath.Base(driver) != "vfio-pci" {
+		return "", fmt.Errorf("PCI device %s is bound to %s, it must be bound to vfio-pci", addr, filepath.Base(driver))
+	}
+
+	return addr, nil
+}
+
+// vgaDevices maps the VGA adapters to the device used to set a resolution.
+var vgaDevices = map[string]string{
+	"std":    "VGA",
+	"virtio": "virtio-vga",
+	"qxl":    "qxl-vga",
+}
+
+// vgaOpts returns the qemu options to configure the display adapter.
+func (q *QEMU) vgaOpts() ([]string, error) {
+	vga := q.machineConfig.VGA
+	if vga == "" && q.machineConfig.Display == "" && q.machineConfig.Arch == "x86_64" {
+		vga = "std"
+	}
+	if vga == "" {
+		if q.machineConfig.Resolution != "" {
+			return nil, fmt.Errorf("a VGA adapter is required to set the resolution")
+		}
+		return nil, nil
+	}
+
+	device, ok := vgaDevices[vga]
+	if !ok {
+		return nil, fmt.Errorf("unsupported VGA adapter %q", vga)
+	}
 
-	if n != len(cmd) {
-		return "", fmt.Errorf("didn't send the full command (%d out of %d bytes)", n, len(cmd))
+	if q.machineConfig.Resolution == "" {
+		return []string{"-vga", vga}, nil
 	}
 
-	// If there is nothing for more than a second, stop
-	if err := conn.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+	var x, y int
+	if _, err := fmt.Sscanf(q.machineConfig.Resolution, "%dx%d", &x, &y); err != nil || x <= 0 || y <= 0 {
+		return nil, fmt.Errorf("invalid resolution %q, expected WIDTHxHEIGHT", q.machineConfig.Resolution)
+	}
+
+	return []string{"-vga", "none", "-device", fmt.Sprintf("%s,xres=%d,yres=%d", device, x, y)}, nil
+}
+
+func (q *QEMU) Config() types.MachineConfig {
+	return q.machineConfig
+}
+
+// qemu monitor: https://qemu-project.gitlab.io/qemu/system/monitor.html
+// nice explanation of how it works: https://unix.stackexchange.com/a/476617
+// unix sockets with golang: https://dev.to/douglasmakey/understanding-unix-domain-sockets-in-golang-32n8
+func (q *QEMU) Screenshot() (string, error) {
+	// Create a temp file name
+	f, err := os.CreateTemp(tempDir(q.machineConfig), "qemu-screenshot-*.png")
+	if err != nil {
 		return "", err
 	}
+	f.Close()
+	os.Remove(f.Name())
 
 	// It seems that the screendump image.png command doesn't have any effect
-	// until we read the data from the socket. I would expect reading the data to
-	// be irrelevant but after trial and errors, this seems to be necessary for some reason.
-	for {
-		b := make([]byte, 1024)
-		if _, err := conn.Read(b); err != nil {
-			break
+	// until we read the data from the socket, which monitorCommand does.
+	if q.machineConfig.RemoteHost == nil {
+		if _, err := q.monitorCommand(fmt.Sprintf("screendump %s", f.Name())); err != nil {
+			return "", err
 		}
+		return f.Name(), nil
 	}
 
-	return f.Name(), nil
+	// qemu writes the screenshot on the remote host, fetch it from there
+	remote := filepath.Join(q.machineConfig.StateDir, filepath.Base(f.Name()))
+	if _, err := q.monitorCommand(fmt.Sprintf("screendump %s", remote)); err != nil {
+		return "", err
+	}
+	defer q.hostSH(fmt.Sprintf("rm -f %s", shellQuote(remote)))
+
+	b, err := q.readHostFile(remote)
+	if err != nil {
+		return "", err
+	}
+	return f.Name(), os.WriteFile(f.Name(), b, 0644)
 }
 
+// Stop kills qemu and removes the machine from the registry, see CleanupAll.
 func (q *QEMU) Stop() error {
+	unregister(q)
+	return q.stop()
+}
+
+// stop kills qemu, keeping the machine registered, e.g. to launch it again.
+func (q *QEMU) stop() error {
+	// Killing the process is not a failure
+	q.stopping.Store(true)
+	q.closeMonitor()
+	q.removeNetem()
+	if q.machineConfig.RemoteHost != nil {
+		return remoteProcess{q: q}.Stop()
+	}
 	return process.New(process.WithStateDir(q.machineConfig.StateDir)).Stop()
 }
 
+// ErrNoStateDir is returned by MustClean when the machine has no state dir to clean.
+var ErrNoStateDir = errors.New("machine has no state dir, nothing to clean")
+
+// MustClean is like Clean, but fails with ErrNoStateDir if there is no state dir to clean.
+func (q *QEMU) MustClean() error {
+	if q.machineConfig.StateDir == "" {
+		return ErrNoStateDir
+	}
+	return q.Clean()
+}
+
 func (q *QEMU) Clean() error {
-	if q.machineConfig.StateDir != "" {
-		return os.RemoveAll(q.machineConfig.StateDir)
+	if q.machineConfig.StateDir == "" {
+		log.Warnf("Machine %s has no state dir, nothing to clean", q.machineConfig.ID)
+	} else {
+		if q.machineConfig.RemoteHost != nil {
+			if out, err := q.hostSH(fmt.Sprintf("rm -rf %s", shellQuote(q.machineConfig.StateDir))); err != nil {
+				return fmt.Errorf("%w - %s", err, out)
+			}
+		}
+		if err := os.RemoveAll(q.machineConfig.StateDir); err != nil {
+			return err
+		}
 	}
+	q.closeHostClient()
+	if err := q.removeCgroup(); err != nil {
+		return err
+	}
+	unregister(q)
 	return nil
 }
 
 func (q *QEMU) Alive() bool {
+	if q.machineConfig.RemoteHost != nil {
+		return remoteProcess{q: q}.IsAlive()
+	}
 	return process.New(process.WithStateDir(q.machineConfig.StateDir)).IsAlive()
 }
 
 func (q *QEMU) CreateDisk(diskname, size string) error {
+	if q.machineConfig.RemoteHost != nil {
+		out, err := q.hostSH(fmt.Sprintf("mkdir -p %s && qemu-img create -f qcow2 %s %s",
+			shellQuote(q.machineConfig.StateDir), shellQuote(filepath.Join(q.machineConfig.StateDir, diskname)), size))
+		if err != nil {
+			return withKind(ErrDiskCreate, fmt.Errorf("%s : %w", out, err))
+		}
+		q.machineConfig.Emit(types.EventDiskCreated, filepath.Join(q.machineConfig.StateDir, diskname))
+		return nil
+	}
+
 	if err := os.MkdirAll(q.machineConfig.StateDir, os.ModePerm); err != nil {
-		return err
+		return withKind(ErrDiskCreate, err)
 	}
 	out, err := utils.SH(fmt.Sprintf("qemu-img create -f qcow2 %s %s", filepath.Join(q.machineConfig.StateDir, diskname), size))
 	if err != nil {
-		return fmt.Errorf("%s : %w", out, err)
+		return withKind(ErrDiskCreate, fmt.Errorf("%s : %w", out, err))
 	}
+	q.machineConfig.Emit(types.EventDiskCreated, filepath.Join(q.machineConfig.StateDir, diskname))
 
 	return nil
 }
@@ -284,13 +1047,11 @@ func (q *QEMU) Command(cmd string) (string, error) {
 	return controller.SSHCommand(q, cmd)
 }
 
-func (q *QEMU) DetachCD() error {
-	conn, err := net.Dial("unix", q.monitorSockFile())
-	if err != nil {
-		return err
-	}
-	defer conn.Close()
+func (q *QEMU) CommandContext(ctx context.Context, cmd string) (string, error) {
+	return controller.SSHCommandContext(ctx, q, cmd)
+}
 
+func (q *QEMU) DetachCD() error {
 	// TODO: Move this to do a info block and then grep for the CDs? May get a little messier
 	/* info block output:
 	$ echo "info block" | socat - unix-connect:/tmp/3611028457/qemu-monitor.sock
@@ -320,32 +1081,115 @@ func (q *QEMU) DetachCD() error {
 	sd0: [not inserted]
 	    Removable device: not locked, tray closed
 	*/
-	cmd := "eject -f ide0-cd0\r\n"
-	n, err := fmt.Fprint(conn, cmd)
+	_, err := q.monitorCommand("eject -f ide0-cd0")
+	return err
+}
+
+// isoDriveID returns the id of the drive backing the primary ISO, which comes
+// right after the disks.
+func (q *QEMU) isoDriveID() string {
+	n := len(q.machineConfig.Drives) + len(q.machineConfig.Disks)
+	if n == 0 && q.machineConfig.AutoDriveSetup {
+		sizes, _ := q.driveSizes()
+		n = len(sizes)
+	}
+	return fmt.Sprintf("drv%d", n)
+}
+
+// AttachCD inserts iso in the CD drive, replacing the current medium if any.
+// The machine must have been created with an ISO for the drive to exist.
+func (q *QEMU) AttachCD(iso string) error {
+	_, err := q.monitorCommand(fmt.Sprintf("change %s %s", q.isoDriveID(), hmpQuote(iso)))
+	return err
+}
+
+// Reset resets the machine, like pressing its reset button.
+func (q *QEMU) Reset() error {
+	_, err := q.monitorCommand("system_reset")
+	return err
+}
+
+// detachTimeout bounds how long DetachDisk waits for the guest to release the disk.
+const detachTimeout = 30 * time.Second
+
+// AttachDisk hot-plugs the disk image at path as a virtio disk of the running machine.
+// The returned id is also used as the disk serial, so the disk shows up in the guest
+// as /dev/disk/by-id/virtio-<id>. Pass it to DetachDisk to remove the disk.
+func (q *QEMU) AttachDisk(path string) (string, error) {
+	id := fmt.Sprintf("hotdisk%s", RandStringRunes(6))
+
+	format, err := q.diskFormat(path)
 	if err != nil {
-		return err
+		return "", err
+	}
+	protocol := "file"
+	if q.isBlockDevice(path) {
+		protocol = "host_device"
 	}
 
-	if n != len(cmd) {
-		return fmt.Errorf("didn't send the full command (%d out of %d bytes)", n, len(cmd))
+	c, err := q.dialQMP()
+	if err != nil {
+		return "", err
 	}
+	defer c.Close()
 
-	// If there is nothing for more than a second, stop
-	if err := conn.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+	node := map[string]interface{}{
+		"node-name": id,
+		"driver":    format,
+		"file":      map[string]string{"driver": protocol, "filename": path},
+	}
+	if err := c.execute("blockdev-add", node, nil); err != nil {
+		return "", err
+	}
+
+	dev := map[string]string{"driver": "virtio-blk-pci", "drive": id, "id": id + "-dev", "serial": id}
+	if err := c.execute("device_add", dev, nil); err != nil {
+		_ = c.execute("blockdev-del", map[string]string{"node-name": id}, nil)
+		return "", err
+	}
+
+	return id, nil
+}
+
+// DetachDisk unplugs a disk previously attached with AttachDisk, waiting for
+// the guest to release it.
+func (q *QEMU) DetachDisk(id string) error {
+	c, err := q.dialQMP()
+	if err != nil {
 		return err
 	}
+	defer c.Close()
 
-	// It seems that the screendump image.png command doesn't have any effect
-	// until we read the data from the socket. I would expect reading the data to
-	// be irrelevant but after trial and errors, this seems to be necessary for some reason.
-	for {
-		b := make([]byte, 1024)
-		if _, err := conn.Read(b); err != nil {
-			break
+	dev := id + "-dev"
+	if err := c.execute("device_del", map[string]string{"id": dev}, nil); err != nil {
+		return err
+	}
+	err = c.waitEvent("DEVICE_DELETED", time.Now().Add(detachTimeout), func(data json.RawMessage) bool {
+		var ev struct {
+			Device string `json:"device"`
 		}
+		return json.Unmarshal(data, &ev) == nil && ev.Device == dev
+	})
+	if err != nil {
+		return fmt.Errorf("disk %s was not released by the guest: %w", id, err)
 	}
+	return c.execute("blockdev-del", map[string]string{"node-name": id}, nil)
+}
 
-	return nil
+// diskFormat returns the format of the disk image at path, e.g. qcow2 or raw,
+// on the host running qemu.
+func (q *QEMU) diskFormat(path string) (string, error) {
+	out, err := q.hostSH(fmt.Sprintf("qemu-img info --output=json %s", shellQuote(path)))
+	if err != nil {
+		return "", fmt.Errorf("reading the format of %s: %w - %s", path, err, out)
+	}
+	var info struct {
+		Format string `json:"format"`
+	}
+	if err := json.Unmarshal([]byte(out), &info); err != nil || info.Format == "" {
+		return "", fmt.Errorf("reading the format of %s: unexpected qemu-img output: %s", path, out)
+	}
+	return info.Format, nil
 }
 
 func (q *QEMU) ReceiveFile(src, dst string) error {
@@ -356,22 +1200,22 @@ func (q *QEMU) SendFile(src, dst, permissions string) error {
 	return controller.SendFile(q, src, dst, permissions)
 }
 
-func (q *QEMU) monitorSockFile() string {
-	return path.Join(q.machineConfig.StateDir, "qemu-monitor.sock")
-}
-
-// Converts the user's drive sizes (which are Mb as strings) to the qemu format.
+// Converts the user's drive sizes (Mb when no unit is given) to the qemu format.
 // https://qemu.readthedocs.io/en/latest/tools/qemu-img.html#cmdoption-qemu-img-arg-create
-func (q *QEMU) driveSizes() []string {
+func (q *QEMU) driveSizes() ([]string, error) {
 	sizes := []string{}
 
 	for _, s := range q.machineConfig.DriveSizes {
-		sizes = append(sizes, fmt.Sprintf("%sM", s))
+		mib, err := types.ParseSizeMiB(s)
+		if err != nil {
+			return nil, fmt.Errorf("drive size: %w", err)
+		}
+		sizes = append(sizes, fmt.Sprintf("%dM", mib))
 	}
 
 	if len(sizes) == 0 {
 		sizes = append(sizes, fmt.Sprintf("%sM", types.DefaultDriveSize))
 	}
 
-	return sizes
+	return sizes, nil
 }
@@ -0,0 +1,352 @@
+package machine
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// monitorSockName is the name of the qemu monitor socket inside the state dir.
+const monitorSockName = "qemu-monitor.sock"
+
+// monitorPrompt is printed by the monitor when it is ready for a command.
+const monitorPrompt = "(qemu) "
+
+// monitorTimeout is how long monitor commands wait for the monitor to come up,
+// and for the reply of most commands.
+const monitorTimeout = 10 * time.Second
+
+// slowMonitorTimeout is how long the commands in slowMonitorCommands wait for
+// their reply.
+const slowMonitorTimeout = 10 * time.Minute
+
+// slowMonitorCommands reply once the work is done, which can take a while
+// with large guests.
+var slowMonitorCommands = map[string]bool{
+	"savevm":            true,
+	"loadvm":            true,
+	"delvm":             true,
+	"migrate":           true,
+	"dump-guest-memory": true,
+	"snapshot_blkdev":   true,
+	"drive_backup":      true,
+	"drive_mirror":      true,
+	"pmemsave":          true,
+	"memsave":           true,
+}
+
+// monitorReplyTimeout returns how long to wait for the reply to cmd.
+func monitorReplyTimeout(cmd string) time.Duration {
+	if f := strings.Fields(cmd); len(f) > 0 && slowMonitorCommands[f[0]] {
+		return slowMonitorTimeout
+	}
+	return monitorTimeout
+}
+
+func (q *QEMU) monitorSockFile() string {
+	if q.machineConfig.MonitorAddr != "" {
+		return q.machineConfig.MonitorAddr
+	}
+	return path.Join(q.machineConfig.StateDir, monitorSockName)
+}
+
+// monitorIsTCP reports whether the monitor was configured to listen on a "host:port" address.
+func (q *QEMU) monitorIsTCP() bool {
+	if q.machineConfig.MonitorAddr == "" || strings.Contains(q.machineConfig.MonitorAddr, "/") {
+		return false
+	}
+	_, _, err := net.SplitHostPort(q.machineConfig.MonitorAddr)
+	return err == nil
+}
+
+// checkMonitorConfig returns an error if TLS is enabled on a unix socket
+// monitor, where it can't be used.
+func (q *QEMU) checkMonitorConfig() error {
+	if q.machineConfig.MonitorTLS != nil && !q.monitorIsTCP() {
+		return fmt.Errorf("monitor TLS requires a \"host:port\" monitor address, not the unix socket %s", q.monitorSockFile())
+	}
+	return nil
+}
+
+// monitorOpts returns the qemu options to set up the monitor.
+func (q *QEMU) monitorOpts() ([]string, error) {
+	if err := q.checkMonitorConfig(); err != nil {
+		return nil, err
+	}
+	if !q.monitorIsTCP() {
+		return []string{"-monitor", fmt.Sprintf("unix:%s,server,nowait", q.monitorSockFile())}, nil
+	}
+
+	t := q.machineConfig.MonitorTLS
+	if t == nil {
+		return []string{"-monitor", fmt.Sprintf("tcp:%s,server,nowait", q.machineConfig.MonitorAddr)}, nil
+	}
+
+	// https://qemu-project.gitlab.io/qemu/system/tls.html
+	host, port, _ := net.SplitHostPort(q.machineConfig.MonitorAddr)
+	verifyPeer := "no"
+	if t.ClientCert != "" {
+		verifyPeer = "yes"
+	}
+	return []string{
+		"-object", fmt.Sprintf("tls-creds-x509,id=montls0,dir=%s,endpoint=server,verify-peer=%s", t.CredsDir, verifyPeer),
+		"-chardev", fmt.Sprintf("socket,id=mon0,host=%s,port=%s,server=on,wait=off,tls-creds=montls0", host, port),
+		"-mon", "chardev=mon0,mode=readline",
+	}, nil
+}
+
+// monitorTLSConfig returns the client TLS configuration to connect to the monitor.
+func (q *QEMU) monitorTLSConfig() (*tls.Config, error) {
+	t := q.machineConfig.MonitorTLS
+	conf := &tls.Config{ServerName: t.ServerName, MinVersion: tls.VersionTLS12}
+	if conf.ServerName == "" {
+		conf.ServerName, _, _ = net.SplitHostPort(q.machineConfig.MonitorAddr)
+	}
+
+	if t.CACert != "" {
+		ca, err := os.ReadFile(t.CACert)
+		if err != nil {
+			return nil, err
+		}
+		conf.RootCAs = x509.NewCertPool()
+		if !conf.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in %s", t.CACert)
+		}
+	}
+
+	if t.ClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(t.ClientCert, t.ClientKey)
+		if err != nil {
+			return nil, err
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+
+	return conf, nil
+}
+
+// monitorCommand sends cmd to the qemu monitor and returns everything it printed back.
+// Errors reported by the monitor are returned as well. The monitor accepts a single
+// client, so commands are serialized over a connection shared by all of them.
+func (q *QEMU) monitorCommand(cmd string) (string, error) {
+	q.monitorLock.Lock()
+	defer q.monitorLock.Unlock()
+
+	if q.monitorConn == nil {
+		if err := q.waitForMonitor(monitorTimeout); err != nil {
+			return "", err
+		}
+		conn, err := q.dialMonitor()
+		if err != nil {
+			return "", withKind(ErrMonitorUnreachable, err)
+		}
+		// Skip the banner, the monitor is ready once it prints its prompt
+		if _, err := readMonitorPrompt(conn, monitorTimeout); err != nil {
+			conn.Close()
+			return "", withKind(ErrMonitorUnreachable, err)
+		}
+		q.monitorConn = conn
+	}
+
+	out, err := q.sendMonitorCommand(q.monitorConn, cmd)
+	var monErr monitorError
+	if err != nil && !errors.As(err, &monErr) {
+		// Don't reuse a broken connection, e.g. if qemu was restarted
+		q.monitorConn.Close()
+		q.monitorConn = nil
+	}
+	return out, err
+}
+
+// MonitorInfo runs "info topic" in the qemu monitor, e.g. "pci", "qtree" or
+// "registers", and returns its reply without the echoed command and prompt.
+func (q *QEMU) MonitorInfo(topic string) (string, error) {
+	topic = strings.TrimSpace(topic)
+	if topic == "" || strings.ContainsAny(topic, "\r\n") {
+		return "", fmt.Errorf("invalid monitor info topic %q", topic)
+	}
+	cmd := "info " + topic
+	out, err := q.monitorCommand(cmd)
+	if err != nil {
+		return "", err
+	}
+	return monitorReply(out, cmd), nil
+}
+
+// hmpQuote quotes s to be passed as a single string argument of a monitor
+// command, e.g. a path with spaces.
+func hmpQuote(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`)
+	return `"` + r.Replace(s) + `"`
+}
+
+// monitorEscape matches the terminal escape sequences the monitor uses when
+// echoing the commands.
+var monitorEscape = regexp.MustCompile(`\x1b\[[0-9;]*[A-Za-z]`)
+
+// monitorReply returns the reply to cmd in the monitor output out, dropping
+// the banner, the echo of cmd and the prompts.
+func monitorReply(out, cmd string) string {
+	out = monitorEscape.ReplaceAllString(out, "")
+	out = strings.ReplaceAll(out, "\r", "")
+	lines := strings.Split(out, "\n")
+
+	for i, l := range lines {
+		if strings.TrimSpace(strings.TrimPrefix(l, monitorPrompt)) == cmd {
+			lines = lines[i+1:]
+			break
+		}
+	}
+	if n := len(lines); n > 0 && strings.HasPrefix(lines[n-1], strings.TrimSpace(monitorPrompt)) {
+		lines = lines[:n-1]
+	}
+	return strings.Join(lines, "\n")
+}
+
+// MonitorConsole gives an interactive session with the qemu monitor, sending
+// each line read from in as a command and writing the replies to out, until in
+// is exhausted. Commands go through the connection shared with the other
+// monitor operations, one line at a time, so it can be used on a live machine.
+// Slow commands such as savevm or migrate get a longer deadline for their reply.
+func (q *QEMU) MonitorConsole(in io.Reader, out io.Writer) error {
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		cmd := strings.TrimSpace(scanner.Text())
+		if cmd == "" {
+			continue
+		}
+		reply, err := q.monitorCommand(cmd)
+		if _, werr := io.WriteString(out, reply); werr != nil {
+			return werr
+		}
+		// Errors reported by the monitor are part of the session
+		var monErr monitorError
+		if err != nil && !errors.As(err, &monErr) {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// closeMonitor closes the connection shared by monitor commands, if any.
+func (q *QEMU) closeMonitor() {
+	q.monitorLock.Lock()
+	defer q.monitorLock.Unlock()
+
+	if q.monitorConn != nil {
+		q.monitorConn.Close()
+		q.monitorConn = nil
+	}
+}
+
+// sendMonitorCommand runs cmd over conn. Errors reported by the monitor itself
+// are returned as monitorError, and don't affect the connection.
+func (q *QEMU) sendMonitorCommand(conn net.Conn, cmd string) (string, error) {
+	if err := conn.SetWriteDeadline(time.Now().Add(monitorTimeout)); err != nil {
+		return "", err
+	}
+
+	cmd = cmd + "\r\n"
+	n, err := fmt.Fprint(conn, cmd)
+	if err != nil {
+		return "", err
+	}
+
+	if n != len(cmd) {
+		return "", fmt.Errorf("didn't send the full command (%d out of %d bytes)", n, len(cmd))
+	}
+
+	out, err := readMonitorPrompt(conn, monitorReplyTimeout(cmd))
+	if err != nil {
+		return out, err
+	}
+
+	for _, l := range strings.Split(out, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(l), "Error:") {
+			return out, monitorError{fmt.Errorf("monitor command %q failed: %s", strings.TrimSpace(cmd), strings.TrimSpace(l))}
+		}
+	}
+
+	return out, nil
+}
+
+// readMonitorPrompt reads from conn until the monitor prints its prompt, which
+// ends the reply to a command, or timeout expires, and returns everything read.
+func readMonitorPrompt(conn net.Conn, timeout time.Duration) (string, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return "", err
+	}
+
+	// Some commands (e.g. screendump) don't have any effect until we read the
+	// data from the socket, so always read the full reply.
+	var out strings.Builder
+	b := make([]byte, 1024)
+	for {
+		n, err := conn.Read(b)
+		out.Write(b[:n])
+		if strings.HasSuffix(out.String(), monitorPrompt) {
+			return out.String(), nil
+		}
+		if err != nil {
+			return out.String(), fmt.Errorf("reading monitor reply: %w", err)
+		}
+	}
+}
+
+// monitorError is an error reported by the monitor in reply to a command.
+type monitorError struct {
+	error
+}
+
+func (e monitorError) Unwrap() error {
+	return e.error
+}
+
+// WaitForMonitor blocks until the qemu monitor accepts connections, or the
+// timeout expires, returning an error wrapping ErrMonitorUnreachable.
+func (q *QEMU) WaitForMonitor(timeout time.Duration) error {
+	return q.waitForMonitor(timeout)
+}
+
+func (q *QEMU) waitForMonitor(timeout time.Duration) error {
+	if err := q.checkMonitorConfig(); err != nil {
+		return err
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		conn, err := q.dialMonitor()
+		if err == nil {
+			return conn.Close()
+		}
+		if time.Now().After(deadline) {
+			return withKind(ErrMonitorUnreachable, fmt.Errorf("monitor not ready after %s: %w", timeout, err))
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func (q *QEMU) dialMonitor() (net.Conn, error) {
+	if err := q.checkMonitorConfig(); err != nil {
+		return nil, err
+	}
+	if q.monitorIsTCP() && q.machineConfig.MonitorTLS != nil {
+		conf, err := q.monitorTLSConfig()
+		if err != nil {
+			return nil, err
+		}
+		return tls.Dial("tcp", q.machineConfig.MonitorAddr, conf)
+	}
+	if q.monitorIsTCP() {
+		return net.Dial("tcp", q.machineConfig.MonitorAddr)
+	}
+	return net.Dial("unix", q.monitorSockFile())
+}
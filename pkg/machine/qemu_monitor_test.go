@@ -0,0 +1,116 @@
+package machine
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spectrocloud/peg/pkg/machine/types"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// fakeMonitor serves an HMP-like monitor on a unix socket, echoing the
+// commands and replying with replies[cmd], or an error for unknown commands,
+// followed by the prompt. Replies are written in two chunks, to check that
+// reads don't stop early.
+func fakeMonitor(sock string, replies map[string]string) net.Listener {
+	l, err := net.Listen("unix", sock)
+	Expect(err).ToNot(HaveOccurred())
+
+	go func() {
+		defer GinkgoRecover()
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				fmt.Fprint(conn, "QEMU 8.2.0 monitor - type 'help' for more information\r\n"+monitorPrompt)
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					cmd := strings.TrimSpace(scanner.Text())
+					r, ok := replies[cmd]
+					if !ok {
+						r = fmt.Sprintf("Error: unknown command: '%s'\r\n", cmd)
+					}
+					reply := cmd + "\r\n" + r
+					fmt.Fprint(conn, reply[:len(reply)/2])
+					time.Sleep(50 * time.Millisecond)
+					fmt.Fprint(conn, reply[len(reply)/2:]+monitorPrompt)
+				}
+			}()
+		}
+	}()
+	return l
+}
+
+var _ = Describe("monitor", func() {
+	var q *QEMU
+
+	BeforeEach(func() {
+		dir, err := os.MkdirTemp("", "peg-monitor")
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(os.RemoveAll, dir)
+
+		sock := filepath.Join(dir, "monitor.sock")
+		l := fakeMonitor(sock, map[string]string{
+			"info status":                           "VM status: running\r\n",
+			"info pci":                              "  Bus  0, device   0, function 0:\r\n    Host bridge: PCI device 8086:1237\r\n",
+			`change drv0 "/isos/my \"new\" cd.iso"`: "",
+		})
+		DeferCleanup(l.Close)
+
+		q = &QEMU{machineConfig: types.MachineConfig{MonitorAddr: sock}}
+		DeferCleanup(q.closeMonitor)
+	})
+
+	It("returns as soon as the prompt is printed", func() {
+		start := time.Now()
+		out, err := q.MonitorInfo("status")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(out).To(Equal("VM status: running"))
+
+		out, err = q.MonitorInfo("pci")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(out).To(Equal("  Bus  0, device   0, function 0:\n    Host bridge: PCI device 8086:1237"))
+		Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+	})
+
+	It("reports errors of the monitor and keeps the connection", func() {
+		_, err := q.monitorCommand("bogus")
+		var monErr monitorError
+		Expect(errors.As(err, &monErr)).To(BeTrue())
+		Expect(err.Error()).To(ContainSubstring("unknown command"))
+
+		out, err := q.MonitorInfo("status")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(out).To(Equal("VM status: running"))
+	})
+
+	It("quotes paths with spaces", func() {
+		Expect(q.AttachCD(`/isos/my "new" cd.iso`)).To(Succeed())
+	})
+
+	It("waits longer for slow commands", func() {
+		Expect(monitorReplyTimeout("info status")).To(Equal(monitorTimeout))
+		Expect(monitorReplyTimeout("savevm snap1")).To(Equal(slowMonitorTimeout))
+		Expect(monitorReplyTimeout("migrate -d tcp:127.0.0.1:4444\r\n")).To(Equal(slowMonitorTimeout))
+	})
+
+	It("rejects TLS on a unix socket", func() {
+		q.machineConfig.MonitorTLS = &types.MonitorTLS{CredsDir: "/etc/pki/qemu"}
+
+		_, err := q.monitorOpts()
+		Expect(err).To(MatchError(ContainSubstring("monitor TLS requires")))
+		_, err = q.MonitorInfo("status")
+		Expect(err).To(MatchError(ContainSubstring("monitor TLS requires")))
+	})
+})
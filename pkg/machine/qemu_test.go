@@ -0,0 +1,51 @@
+package machine
+
+import (
+	"github.com/spectrocloud/peg/pkg/machine/types"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("smpArg", func() {
+	DescribeTable("builds the CPU topology",
+		func(mc types.MachineConfig, expected string) {
+			smp, err := smpArg(mc)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(smp).To(Equal(expected))
+		},
+		Entry("total only", types.MachineConfig{CPU: "4"}, "cores=4"),
+		Entry("total split in sockets", types.MachineConfig{CPU: "8", CPUSockets: 2, CPUThreads: 2}, "8,sockets=2,cores=2,threads=2"),
+		Entry("topology only", types.MachineConfig{CPUSockets: 2, CPUCores: 3}, "6,sockets=2,cores=3,threads=1"),
+		Entry("matching total", types.MachineConfig{CPU: "6", CPUSockets: 2, CPUCores: 3}, "6,sockets=2,cores=3,threads=1"),
+	)
+
+	DescribeTable("rejects inconsistent topologies",
+		func(mc types.MachineConfig) {
+			_, err := smpArg(mc)
+			Expect(err).To(HaveOccurred())
+		},
+		Entry("total not matching", types.MachineConfig{CPU: "4", CPUSockets: 2, CPUCores: 3}),
+		Entry("total not divisible", types.MachineConfig{CPU: "6", CPUSockets: 4}),
+		Entry("invalid total", types.MachineConfig{CPU: "many", CPUThreads: 2}),
+	)
+
+	It("keeps the total in sync with the topology option", func() {
+		mc := types.DefaultMachineConfig()
+		Expect(mc.Apply(types.WithCPUTopology(2, 4, 2))).To(Succeed())
+		Expect(mc.CPU).To(Equal("16"))
+
+		Expect(mc.Apply(types.WithCPU("4"))).To(Succeed())
+		_, err := smpArg(*mc)
+		Expect(err).To(MatchError(ContainSubstring("doesn't match")))
+	})
+})
+
+var _ = Describe("virtioSerialOpts", func() {
+	It("escapes commas in the socket paths", func() {
+		q := &QEMU{machineConfig: types.MachineConfig{GuestAgentSocket: "/tmp/a,b/qga.sock"}}
+		opts, err := q.virtioSerialOpts()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(opts).To(ContainElement("socket,path=/tmp/a,,b/qga.sock,server=on,wait=off,id=qga0"))
+	})
+})
@@ -0,0 +1,154 @@
+package machine
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"path"
+	"time"
+)
+
+// qmpSockName is the name of the QMP socket inside the state dir.
+const qmpSockName = "qmp.sock"
+
+// qmpTimeout bounds a single QMP command.
+const qmpTimeout = 10 * time.Second
+
+func (q *QEMU) qmpSockFile() string {
+	return path.Join(q.machineConfig.StateDir, qmpSockName)
+}
+
+// qmpOpts returns the qemu options to set up the QMP socket, used for the
+// operations that need the replies or events in a machine readable form.
+func (q *QEMU) qmpOpts() []string {
+	return []string{"-qmp", fmt.Sprintf("unix:%s,server=on,wait=off", q.qmpSockFile())}
+}
+
+// qmpMessage is a reply or an event sent by QMP.
+// See https://qemu-project.gitlab.io/qemu/interop/qmp-spec.html
+type qmpMessage struct {
+	Return json.RawMessage `json:"return"`
+	Error  *struct {
+		Class string `json:"class"`
+		Desc  string `json:"desc"`
+	} `json:"error"`
+	Event string          `json:"event"`
+	Data  json.RawMessage `json:"data"`
+}
+
+// qmpConn is a QMP session. QMP accepts a single client, so the session holds
+// the QMP lock of the machine until it is closed.
+type qmpConn struct {
+	q      *QEMU
+	conn   net.Conn
+	enc    *json.Encoder
+	dec    *json.Decoder
+	events []qmpMessage
+	closed bool
+}
+
+// dialQMP opens a QMP session with qemu, on the host running it.
+func (q *QEMU) dialQMP() (*qmpConn, error) {
+	q.qmpLock.Lock()
+	conn, err := q.dialHostUnix(q.qmpSockFile())
+	if err != nil {
+		q.qmpLock.Unlock()
+		return nil, fmt.Errorf("connecting to QMP: %w", err)
+	}
+	c := &qmpConn{q: q, conn: conn, enc: json.NewEncoder(conn), dec: json.NewDecoder(conn)}
+
+	// Skip the greeting, commands are accepted once capabilities are negotiated
+	if err := conn.SetDeadline(time.Now().Add(qmpTimeout)); err != nil {
+		c.Close()
+		return nil, err
+	}
+	var greeting map[string]json.RawMessage
+	if err := c.dec.Decode(&greeting); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("reading QMP greeting: %w", err)
+	}
+	if err := c.execute("qmp_capabilities", nil, nil); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// qmpCommand runs a single QMP command, see qmpConn.execute.
+func (q *QEMU) qmpCommand(command string, args, result interface{}) error {
+	c, err := q.dialQMP()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	return c.execute(command, args, result)
+}
+
+// execute runs command with args and unmarshals its return value into result
+// if not nil. Events received meanwhile are kept for waitEvent.
+func (c *qmpConn) execute(command string, args, result interface{}) error {
+	if err := c.conn.SetDeadline(time.Now().Add(qmpTimeout)); err != nil {
+		return err
+	}
+
+	req := map[string]interface{}{"execute": command}
+	if args != nil {
+		req["arguments"] = args
+	}
+	if err := c.enc.Encode(req); err != nil {
+		return err
+	}
+
+	for {
+		var msg qmpMessage
+		if err := c.dec.Decode(&msg); err != nil {
+			return fmt.Errorf("reading QMP reply to %s: %w", command, err)
+		}
+		if msg.Event != "" {
+			c.events = append(c.events, msg)
+			continue
+		}
+		if msg.Error != nil {
+			return fmt.Errorf("QMP %s failed: %s: %s", command, msg.Error.Class, msg.Error.Desc)
+		}
+		if result != nil {
+			return json.Unmarshal(msg.Return, result)
+		}
+		return nil
+	}
+}
+
+// waitEvent waits until done returns true for the data of an event called
+// name, or the deadline expires. The session can't be used after a timeout.
+func (c *qmpConn) waitEvent(name string, deadline time.Time, done func(data json.RawMessage) bool) error {
+	for len(c.events) > 0 {
+		msg := c.events[0]
+		c.events = c.events[1:]
+		if msg.Event == name && done(msg.Data) {
+			return nil
+		}
+	}
+
+	if err := c.conn.SetDeadline(deadline); err != nil {
+		return err
+	}
+	for {
+		var msg qmpMessage
+		if err := c.dec.Decode(&msg); err != nil {
+			return fmt.Errorf("waiting for QMP event %s: %w", name, err)
+		}
+		if msg.Event == name && done(msg.Data) {
+			return nil
+		}
+	}
+}
+
+// Close ends the session. It can be called more than once.
+func (c *qmpConn) Close() error {
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	defer c.q.qmpLock.Unlock()
+	return c.conn.Close()
+}
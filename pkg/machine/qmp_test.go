@@ -0,0 +1,110 @@
+package machine
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/spectrocloud/peg/pkg/machine/types"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// fakeQMP serves QMP on a unix socket. Commands in events get the events sent
+// before their empty reply, the others fail with a CommandNotFound error.
+func fakeQMP(sock string, events map[string][]string) net.Listener {
+	l, err := net.Listen("unix", sock)
+	Expect(err).ToNot(HaveOccurred())
+
+	go func() {
+		defer GinkgoRecover()
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				enc := json.NewEncoder(conn)
+				dec := json.NewDecoder(conn)
+				_ = enc.Encode(map[string]interface{}{"QMP": map[string]interface{}{"version": map[string]interface{}{}, "capabilities": []string{}}})
+				for {
+					var req struct {
+						Execute string `json:"execute"`
+					}
+					if dec.Decode(&req) != nil {
+						return
+					}
+					evs, ok := events[req.Execute]
+					if !ok && req.Execute != "qmp_capabilities" {
+						_ = enc.Encode(map[string]interface{}{"error": map[string]string{"class": "CommandNotFound", "desc": "The command " + req.Execute + " has not been found"}})
+						continue
+					}
+					for _, status := range evs {
+						_ = enc.Encode(map[string]interface{}{"event": "MIGRATION", "data": map[string]string{"status": status}})
+					}
+					_ = enc.Encode(map[string]interface{}{"return": map[string]interface{}{}})
+				}
+			}()
+		}
+	}()
+	return l
+}
+
+var _ = Describe("QMP", func() {
+	var q *QEMU
+
+	BeforeEach(func() {
+		dir, err := os.MkdirTemp("", "peg-qmp")
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(os.RemoveAll, dir)
+
+		l := fakeQMP(filepath.Join(dir, qmpSockName), map[string][]string{
+			"migrate": {"setup", "active", "completed"},
+		})
+		DeferCleanup(l.Close)
+
+		q = &QEMU{machineConfig: types.MachineConfig{StateDir: dir}}
+	})
+
+	It("returns the errors of the commands", func() {
+		err := q.qmpCommand("blockdev-snapshot", nil, nil)
+		Expect(err).To(MatchError(ContainSubstring("CommandNotFound")))
+	})
+
+	It("keeps the events received before a reply", func() {
+		c, err := q.dialQMP()
+		Expect(err).ToNot(HaveOccurred())
+		defer c.Close()
+
+		Expect(c.execute("migrate", map[string]string{"uri": "tcp:127.0.0.1:4444"}, nil)).To(Succeed())
+
+		var seen []string
+		err = c.waitEvent("MIGRATION", time.Now().Add(time.Second), func(data json.RawMessage) bool {
+			var ev struct {
+				Status string `json:"status"`
+			}
+			Expect(json.Unmarshal(data, &ev)).To(Succeed())
+			seen = append(seen, ev.Status)
+			return ev.Status == "completed"
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(seen).To(Equal([]string{"setup", "active", "completed"}))
+	})
+
+	It("times out waiting for events", func() {
+		c, err := q.dialQMP()
+		Expect(err).ToNot(HaveOccurred())
+		defer c.Close()
+
+		err = c.waitEvent("MIGRATION", time.Now().Add(100*time.Millisecond), func(json.RawMessage) bool { return true })
+		Expect(err).To(HaveOccurred())
+
+		// The lock is released on close, so new sessions can be opened
+		Expect(c.Close()).To(Succeed())
+		Expect(q.qmpCommand("qmp_capabilities", nil, nil)).To(Succeed())
+	})
+})
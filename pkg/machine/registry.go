@@ -0,0 +1,53 @@
+package machine
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/spectrocloud/peg/pkg/machine/types"
+)
+
+var (
+	registryLock sync.Mutex
+	registry     = map[string]types.Machine{}
+)
+
+// register tracks a machine so it can be cleaned up by CleanupAll.
+func register(m types.Machine) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	registry[m.Config().ID] = m
+}
+
+// unregister drops a machine from the registry once it has been stopped or cleaned up.
+func unregister(m types.Machine) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	delete(registry, m.Config().ID)
+}
+
+// CleanupAll stops and cleans every machine that was created and not stopped
+// or cleaned yet, as Stop and Clean remove the machines from the registry.
+// VBox machines stay registered after Stop, which doesn't power them off.
+// It is safe to call from multiple goroutines, e.g. deferred at suite level.
+func CleanupAll() error {
+	registryLock.Lock()
+	machines := make([]types.Machine, 0, len(registry))
+	for _, m := range registry {
+		machines = append(machines, m)
+	}
+	registryLock.Unlock()
+
+	var errs []error
+	for _, m := range machines {
+		if err := m.Stop(); err != nil {
+			log.Warnf("failed stopping machine %s: %s", m.Config().ID, err.Error())
+		}
+		if err := m.Clean(); err != nil {
+			errs = append(errs, fmt.Errorf("cleaning machine %s: %w", m.Config().ID, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,282 @@
+package machine
+
+import (
+	"fmt"
+	mrand "math/rand"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spectrocloud/peg/internal/utils"
+	"github.com/spectrocloud/peg/pkg/machine/types"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// shellQuote quotes s to be passed as a single argument to sh.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// remoteClient connects to the host running qemu.
+func remoteClient(r *types.RemoteHost) (*ssh.Client, error) {
+	key, err := os.ReadFile(r.Key)
+	if err != nil {
+		return nil, fmt.Errorf("reading key for remote host %s: %w", r.Host, err)
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("parsing key for remote host %s: %w", r.Host, err)
+	}
+
+	hostKeyCallback := ssh.InsecureIgnoreHostKey()
+	if r.KnownHosts != "" {
+		hostKeyCallback, err = knownhosts.New(r.KnownHosts)
+		if err != nil {
+			return nil, fmt.Errorf("loading known hosts: %w", err)
+		}
+	}
+
+	port := r.Port
+	if port == "" {
+		port = "22"
+	}
+
+	return ssh.Dial("tcp", net.JoinHostPort(r.Host, port), &ssh.ClientConfig{
+		User:            r.User,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         30 * time.Second,
+	})
+}
+
+// remoteSH runs c with sh on the remote host, over a new connection. If
+// stdoutOnly is set the error output is discarded, which is needed to read
+// binary files.
+func remoteSH(r *types.RemoteHost, c string, stdoutOnly bool) (string, error) {
+	client, err := remoteClient(r)
+	if err != nil {
+		return "", err
+	}
+	defer client.Close()
+
+	return sessionSH(client, r, c, stdoutOnly)
+}
+
+// sessionSH runs c with sh in a new session of client, see remoteSH.
+func sessionSH(client *ssh.Client, r *types.RemoteHost, c string, stdoutOnly bool) (string, error) {
+	logging := log.With("host", r.Host)
+	logging.Debugf("Executing remote sh command: %s", c)
+
+	session, err := client.NewSession()
+	if err != nil {
+		return "", err
+	}
+	defer session.Close()
+
+	var out []byte
+	if stdoutOnly {
+		out, err = session.Output(c)
+	} else {
+		out, err = session.CombinedOutput(c)
+	}
+	return string(out), err
+}
+
+// hostClient returns the connection to the RemoteHost shared by the commands
+// of the machine, connecting first if needed.
+func (q *QEMU) hostClient() (*ssh.Client, error) {
+	q.remoteLock.Lock()
+	defer q.remoteLock.Unlock()
+
+	if q.remote != nil {
+		// Check that the connection is still up, e.g. after a network blip
+		if _, _, err := q.remote.SendRequest("keepalive@openssh.com", true, nil); err == nil {
+			return q.remote, nil
+		}
+		q.remote.Close()
+		q.remote = nil
+	}
+
+	client, err := remoteClient(q.machineConfig.RemoteHost)
+	if err != nil {
+		return nil, err
+	}
+	q.remote = client
+	return client, nil
+}
+
+// closeHostClient closes the connection to the RemoteHost, if any.
+func (q *QEMU) closeHostClient() {
+	q.remoteLock.Lock()
+	defer q.remoteLock.Unlock()
+
+	if q.remote != nil {
+		q.remote.Close()
+		q.remote = nil
+	}
+}
+
+// remoteSH runs c on the RemoteHost over the shared connection, see remoteSH.
+func (q *QEMU) remoteSH(c string, stdoutOnly bool) (string, error) {
+	client, err := q.hostClient()
+	if err != nil {
+		return "", err
+	}
+	return sessionSH(client, q.machineConfig.RemoteHost, c, stdoutOnly)
+}
+
+// hostSH runs c on the host running qemu: locally, or on the RemoteHost if set.
+func (q *QEMU) hostSH(c string) (string, error) {
+	if q.machineConfig.RemoteHost == nil {
+		return utils.SH(c)
+	}
+	return q.remoteSH(c, false)
+}
+
+// dialHostUnix connects to the unix socket path on the host running qemu.
+func (q *QEMU) dialHostUnix(path string) (net.Conn, error) {
+	if q.machineConfig.RemoteHost == nil {
+		return net.Dial("unix", path)
+	}
+	client, err := q.hostClient()
+	if err != nil {
+		return nil, err
+	}
+	return client.Dial("unix", path)
+}
+
+// allocateHostPort returns a free TCP port between min and max (inclusive) on
+// the host running qemu. If both are 0, any free port is returned.
+func (q *QEMU) allocateHostPort(min, max int) (int, error) {
+	if q.machineConfig.RemoteHost == nil {
+		return AllocateFreePort(min, max)
+	}
+	return allocateRemotePort(q.machineConfig.RemoteHost, q.hostSH, min, max)
+}
+
+// allocateRemotePort returns a free TCP port between min and max (inclusive)
+// on the remote host r, listing the ports in use with sh. If both are 0, any
+// free port is returned.
+func allocateRemotePort(r *types.RemoteHost, sh func(string) (string, error), min, max int) (int, error) {
+	if min == 0 && max == 0 {
+		// The dynamic ports range
+		min, max = 49152, 65535
+	}
+	if min <= 0 || max > 65535 || min > max {
+		return 0, fmt.Errorf("invalid port range %d-%d", min, max)
+	}
+
+	out, err := sh("ss -Hltn")
+	if err != nil {
+		return 0, fmt.Errorf("listing the ports in use on %s: %w - %s", r.Host, err, out)
+	}
+	used := map[int]bool{}
+	for _, l := range strings.Split(out, "\n") {
+		fields := strings.Fields(l)
+		if len(fields) < 4 {
+			continue
+		}
+		// The local address, e.g. 0.0.0.0:22, [::]:22 or *:22
+		addr := fields[3]
+		if port, err := strconv.Atoi(addr[strings.LastIndex(addr, ":")+1:]); err == nil {
+			used[port] = true
+		}
+	}
+
+	size := max - min + 1
+	start := mrand.Intn(size)
+	for i := 0; i < size; i++ {
+		port := min + (start+i)%size
+		if !used[port] {
+			return port, nil
+		}
+	}
+	return 0, fmt.Errorf("no free port in range %d-%d on %s", min, max, r.Host)
+}
+
+// hostLookPath finds an executable on the host running qemu.
+func (q *QEMU) hostLookPath(name string) (string, error) {
+	if q.machineConfig.RemoteHost == nil {
+		return exec.LookPath(name)
+	}
+	out, err := q.hostSH(fmt.Sprintf("command -v %s", shellQuote(name)))
+	if err != nil {
+		return "", fmt.Errorf("%s not found on %s: %w", name, q.machineConfig.RemoteHost.Host, err)
+	}
+	return strings.TrimSpace(out), nil
+}
+
+// readStateFile reads a file from the state dir, on the host running qemu.
+func (q *QEMU) readStateFile(name string) ([]byte, error) {
+	return q.readHostFile(filepath.Join(q.machineConfig.StateDir, name))
+}
+
+// hasStateFile reports whether the file name exists in the state dir, on the host running qemu.
+func (q *QEMU) hasStateFile(name string) bool {
+	_, err := q.hostSH(fmt.Sprintf("test -e %s", shellQuote(filepath.Join(q.machineConfig.StateDir, name))))
+	return err == nil
+}
+
+// readHostFile reads a file on the host running qemu.
+func (q *QEMU) readHostFile(path string) ([]byte, error) {
+	if q.machineConfig.RemoteHost == nil {
+		return os.ReadFile(path)
+	}
+	out, err := q.remoteSH(fmt.Sprintf("cat %s", shellQuote(path)), true)
+	return []byte(out), err
+}
+
+// remoteProcess tracks a qemu process started on a remote host by launchRemote.
+type remoteProcess struct {
+	q *QEMU
+}
+
+func (r remoteProcess) IsAlive() bool {
+	_, err := r.q.hostSH(fmt.Sprintf("kill -0 $(cat %s)", shellQuote(filepath.Join(r.q.machineConfig.StateDir, "pid"))))
+	return err == nil
+}
+
+func (r remoteProcess) ExitCode() (string, error) {
+	b, err := r.q.readStateFile("exitcode")
+	return strings.TrimSpace(string(b)), err
+}
+
+func (r remoteProcess) Stop() error {
+	pid := shellQuote(filepath.Join(r.q.machineConfig.StateDir, "pid"))
+	out, err := r.q.hostSH(fmt.Sprintf("kill -9 $(cat %[1]s) && rm -f %[1]s", pid))
+	if err != nil {
+		return fmt.Errorf("%w - %s", err, out)
+	}
+	return nil
+}
+
+// launchRemote starts qemu in the background on the remote host, recording its pid,
+// output and exit code in the state dir like the local process manager does.
+func (q *QEMU) launchRemote(name string, args []string) error {
+	cmd := []string{shellQuote(name)}
+	for _, a := range args {
+		cmd = append(cmd, shellQuote(a))
+	}
+
+	dir := shellQuote(q.machineConfig.StateDir)
+	script := fmt.Sprintf("cd %s && (%s >stdout 2>stderr & echo $! > pid; wait $!; echo $? > exitcode)", dir, strings.Join(cmd, " "))
+
+	out, err := q.hostSH(fmt.Sprintf("mkdir -p %[1]s && rm -f %[1]s/exitcode && setsid nohup sh -c %[2]s >/dev/null 2>&1 < /dev/null &", dir, shellQuote(script)))
+	if err != nil {
+		return fmt.Errorf("starting qemu on %s: %w - %s", q.machineConfig.RemoteHost.Host, err, out)
+	}
+
+	// Wait for the pid to be recorded
+	for i := 0; i < 10; i++ {
+		if _, err := q.readStateFile("pid"); err == nil {
+			return nil
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	return fmt.Errorf("qemu did not start on %s", q.machineConfig.RemoteHost.Host)
+}
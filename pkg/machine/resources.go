@@ -0,0 +1,91 @@
+package machine
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// userHZ is the unit of the CPU times in /proc/<pid>/stat, fixed to 100 by the kernel ABI.
+const userHZ = 100
+
+// ResourceStats is the host resource usage of the qemu process of a machine.
+type ResourceStats struct {
+	// UserTime and SystemTime are the CPU time spent by qemu, including the vCPUs.
+	UserTime   time.Duration
+	SystemTime time.Duration
+	// RSS and PeakRSS are the resident memory of qemu, in bytes.
+	RSS     uint64
+	PeakRSS uint64
+}
+
+// CPUTime returns the total CPU time spent by qemu.
+func (s ResourceStats) CPUTime() time.Duration {
+	return s.UserTime + s.SystemTime
+}
+
+// ResourceUsage returns the host CPU time and memory used by the qemu process.
+func (q *QEMU) ResourceUsage() (ResourceStats, error) {
+	s := ResourceStats{}
+	if !q.Alive() {
+		return s, errors.New("the machine is not running")
+	}
+
+	pid, err := q.readStateFile("pid")
+	if err != nil {
+		return s, fmt.Errorf("reading qemu pid: %w", err)
+	}
+	proc := "/proc/" + strings.TrimSpace(string(pid))
+
+	stat, err := q.readHostFile(proc + "/stat")
+	if err != nil {
+		return s, fmt.Errorf("reading qemu stat: %w", err)
+	}
+	// The command name may contain spaces, the fields start after it
+	i := bytes.LastIndexByte(stat, ')')
+	if i == -1 {
+		return s, fmt.Errorf("unexpected stat content: %s", stat)
+	}
+	fields := strings.Fields(string(stat[i+1:]))
+	if len(fields) < 13 {
+		return s, fmt.Errorf("unexpected stat content: %s", stat)
+	}
+	// utime and stime are the 14th and 15th fields, the first after the name being the 3rd
+	utime, err := strconv.ParseUint(fields[11], 10, 64)
+	if err != nil {
+		return s, fmt.Errorf("invalid utime %q", fields[11])
+	}
+	stime, err := strconv.ParseUint(fields[12], 10, 64)
+	if err != nil {
+		return s, fmt.Errorf("invalid stime %q", fields[12])
+	}
+	s.UserTime = time.Duration(utime) * time.Second / userHZ
+	s.SystemTime = time.Duration(stime) * time.Second / userHZ
+
+	status, err := q.readHostFile(proc + "/status")
+	if err != nil {
+		return s, fmt.Errorf("reading qemu status: %w", err)
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(status))
+	for scanner.Scan() {
+		// e.g. "VmRSS:	  123456 kB"
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok || (key != "VmRSS" && key != "VmHWM") {
+			continue
+		}
+		kb, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimSpace(value), " kB"), 10, 64)
+		if err != nil {
+			return s, fmt.Errorf("invalid %s %q", key, value)
+		}
+		if key == "VmRSS" {
+			s.RSS = kb * 1024
+		} else {
+			s.PeakRSS = kb * 1024
+		}
+	}
+	return s, nil
+}
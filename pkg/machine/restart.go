@@ -0,0 +1,96 @@
+package machine
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/spectrocloud/peg/internal/utils"
+	"github.com/spectrocloud/peg/pkg/machine/types"
+)
+
+// restartExitTimeout bounds how long ColdRestart waits for the old process to exit.
+const restartExitTimeout = 30 * time.Second
+
+// ColdRestart stops the qemu process, waits for it to exit and creates it again
+// with the same config and state dir. Unlike Create, it keeps the disks
+// created by AutoDriveSetup, so that the guest boots from them again.
+func (q *QEMU) ColdRestart(ctx context.Context) (context.Context, error) {
+	// Stop removes the pid file, read it first to wait for the process
+	pid, err := q.readStateFile("pid")
+	if err != nil {
+		return ctx, fmt.Errorf("reading the pid of the machine: %w", err)
+	}
+	if err := q.stop(); err != nil {
+		return ctx, fmt.Errorf("stopping the machine: %w", err)
+	}
+	if err := waitForExit(fmt.Sprintf("qemu process %s", strings.TrimSpace(string(pid))), func() bool {
+		_, err := q.hostSH(fmt.Sprintf("kill -0 %s", shellQuote(strings.TrimSpace(string(pid)))))
+		return err != nil
+	}); err != nil {
+		return ctx, err
+	}
+
+	q.reuseDisks = true
+	defer func() { q.reuseDisks = false }()
+	return q.Create(ctx)
+}
+
+// ColdRestart stops the container, waits for it to exit and starts it again,
+// keeping its filesystem.
+func (q *Docker) ColdRestart(ctx context.Context) (context.Context, error) {
+	if err := q.Stop(); err != nil {
+		return ctx, err
+	}
+	if err := waitForExit(fmt.Sprintf("container %s", q.machineConfig.ID), func() bool {
+		out, err := utils.SH(fmt.Sprintf("%s container inspect -f '{{.State.Running}}' %s", q.whereIsDocker(), q.machineConfig.ID))
+		return err == nil && strings.TrimSpace(out) == "false"
+	}); err != nil {
+		return ctx, err
+	}
+
+	out, err := utils.SH(fmt.Sprintf("%s start %s", q.whereIsDocker(), q.machineConfig.ID))
+	if err != nil {
+		return ctx, failed(q.machineConfig, fmt.Errorf("failed starting container: %w - %s", err, out))
+	}
+	register(q)
+	q.machineConfig.Emit(types.EventProcessStarted, q.machineConfig.ID)
+	return ctx, failed(q.machineConfig, postCreate(q))
+}
+
+// ColdRestart powers off the VM, waits for it to be off and starts it again,
+// keeping its disks. Unlike Restart, which resets the VM, it runs PostCreate again.
+func (v *VBox) ColdRestart(ctx context.Context) (context.Context, error) {
+	if out, err := utils.SH(fmt.Sprintf(`VBoxManage controlvm "%s" poweroff`, v.machineConfig.ID)); err != nil {
+		return ctx, fmt.Errorf("while powering off VM: %w - %s", err, out)
+	}
+	if err := waitForExit(fmt.Sprintf("VM %s", v.machineConfig.ID), func() bool {
+		out, err := utils.SH(fmt.Sprintf(`VBoxManage showvminfo "%s" --machinereadable`, v.machineConfig.ID))
+		return err == nil && strings.Contains(out, `VMState="poweroff"`)
+	}); err != nil {
+		return ctx, err
+	}
+
+	out, err := utils.SH(fmt.Sprintf(`VBoxManage startvm "%s" --type headless`, v.machineConfig.ID))
+	if err != nil {
+		return ctx, failed(v.machineConfig, fmt.Errorf("while starting VM: %w - %s", err, out))
+	}
+	v.machineConfig.Emit(types.EventProcessStarted, v.machineConfig.ID)
+	return ctx, failed(v.machineConfig, postCreate(v))
+}
+
+// waitForExit waits until exited reports that what is gone, so that it doesn't
+// hold the disks and ports anymore when the machine is started again.
+func waitForExit(what string, exited func() bool) error {
+	deadline := time.Now().Add(restartExitTimeout)
+	for {
+		if exited() {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s did not exit after %s", what, restartExitTimeout)
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
@@ -0,0 +1,126 @@
+package machine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// SerialLogPath returns the file where the serial console output of the machine is written.
+func (q *QEMU) SerialLogPath() (string, error) {
+	if q.machineConfig.SerialLogFile != "" {
+		return q.machineConfig.SerialLogFile, nil
+	}
+	// -nographic sends the serial console to stdout, which is kept in the state dir
+	if q.machineConfig.Display == "" {
+		return filepath.Join(q.machineConfig.StateDir, "stdout"), nil
+	}
+	return "", errors.New("the serial console is not captured, set SerialLogFile")
+}
+
+// WaitForSerialLine waits until a line of the serial console output matches
+// the regular expression pattern, or timeout expires.
+func (q *QEMU) WaitForSerialLine(pattern string, timeout time.Duration) error {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return err
+	}
+	logPath, err := q.SerialLogPath()
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(timeout)
+	checked := 0
+	for {
+		// Only complete lines are checked, a partial one is checked again once finished
+		b, err := q.readHostFile(logPath)
+		if err == nil && len(b) < checked {
+			// The log was trimmed by capSerialLog
+			checked = 0
+		}
+		if err == nil && len(b) > checked {
+			if end := strings.LastIndexByte(string(b), '\n'); end >= checked {
+				for _, l := range strings.Split(string(b[checked:end]), "\n") {
+					if re.MatchString(strings.TrimRight(l, "\r")) {
+						return nil
+					}
+				}
+				checked = end + 1
+			}
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("no line matching %q on the serial console after %s", pattern, timeout)
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+// serialLogOpts returns the qemu options writing the serial console to SerialLogFile.
+func (q *QEMU) serialLogOpts() ([]string, error) {
+	if q.machineConfig.SerialLogMaxBytes == 0 {
+		return []string{"-serial", "file:" + q.machineConfig.SerialLogFile}, nil
+	}
+	if q.machineConfig.RemoteHost != nil {
+		return nil, errors.New("capping the serial log is not supported with a remote host")
+	}
+	// In append mode qemu keeps writing at the end of the file once capSerialLog trims it
+	path := strings.ReplaceAll(q.machineConfig.SerialLogFile, ",", ",,")
+	return []string{
+		"-chardev", fmt.Sprintf("file,id=serial0,path=%s,append=on", path),
+		"-serial", "chardev:serial0",
+	}, nil
+}
+
+// capSerialLog trims the serial log to its last SerialLogMaxBytes bytes every
+// few seconds, until ctx is done.
+func (q *QEMU) capSerialLog(ctx context.Context) {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := trimFile(q.machineConfig.SerialLogFile, q.machineConfig.SerialLogMaxBytes); err != nil {
+				log.Warnf("Failed trimming serial log %s: %s", q.machineConfig.SerialLogFile, err.Error())
+			}
+		}
+	}
+}
+
+// trimFile keeps the last maxBytes bytes of the file at path, if it is larger.
+// Output written while it is trimmed may be lost.
+func trimFile(path string, maxBytes int64) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil || fi.Size() <= maxBytes {
+		return err
+	}
+
+	tail := make([]byte, maxBytes)
+	if _, err := f.ReadAt(tail, fi.Size()-maxBytes); err != nil && err != io.EOF {
+		return err
+	}
+	// Start with a whole line
+	if i := strings.IndexByte(string(tail), '\n'); i != -1 {
+		tail = tail[i+1:]
+	}
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	_, err = f.WriteAt(tail, 0)
+	return err
+}
@@ -0,0 +1,45 @@
+package machine
+
+import (
+	"context"
+	"sync"
+)
+
+var (
+	createGateLock sync.Mutex
+	// createGate holds a token for each Create in progress, nil when unlimited
+	createGate chan struct{}
+)
+
+// SetMaxConcurrentCreates limits how many machines are created at the same
+// time, to avoid load spikes on the host when a suite starts many machines.
+// Create calls above the limit wait for a running one to finish. Zero or a
+// negative n, the default, means unlimited. Calls already waiting keep the
+// previous limit.
+func SetMaxConcurrentCreates(n int) {
+	createGateLock.Lock()
+	defer createGateLock.Unlock()
+	if n <= 0 {
+		createGate = nil
+		return
+	}
+	createGate = make(chan struct{}, n)
+}
+
+// acquireCreate waits for a Create slot, or for ctx to be done, and returns
+// the function releasing it.
+func acquireCreate(ctx context.Context) (func(), error) {
+	createGateLock.Lock()
+	gate := createGate
+	createGateLock.Unlock()
+	if gate == nil {
+		return func() {}, nil
+	}
+
+	select {
+	case gate <- struct{}{}:
+		return func() { <-gate }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
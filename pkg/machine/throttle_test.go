@@ -0,0 +1,57 @@
+package machine
+
+import (
+	"context"
+	"time"
+
+	"github.com/spectrocloud/peg/pkg/machine/types"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("SetMaxConcurrentCreates", func() {
+	AfterEach(func() {
+		SetMaxConcurrentCreates(0)
+	})
+
+	It("doesn't wait when unlimited", func() {
+		release, err := acquireCreate(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+		release()
+	})
+
+	It("waits for a slot to be released", func() {
+		SetMaxConcurrentCreates(1)
+		release, err := acquireCreate(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		_, err = acquireCreate(ctx)
+		Expect(err).To(MatchError(context.DeadlineExceeded))
+
+		release()
+		release, err = acquireCreate(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+		release()
+	})
+
+	It("releases the slot before PostCreate", func() {
+		SetMaxConcurrentCreates(1)
+
+		// "true" stands in for docker, so that the container "starts" right away
+		inner := &Docker{machineConfig: types.MachineConfig{ID: "inner", Process: "true"}}
+		outer := &Docker{machineConfig: types.MachineConfig{ID: "outer", Process: "true", PostCreate: func(types.Machine) error {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			_, err := inner.Create(ctx)
+			return err
+		}}}
+		DeferCleanup(unregister, inner)
+		DeferCleanup(unregister, outer)
+
+		_, err := outer.Create(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+	})
+})
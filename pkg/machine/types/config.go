@@ -4,18 +4,136 @@ import (
 	"fmt"
 	"io/ioutil"
 
-	process "github.com/mudler/go-processmanager"
+	"golang.org/x/crypto/ssh"
 	"gopkg.in/yaml.v3"
 )
 
 const (
 	DefaultDriveSize = "30000" // Mb
+	DefaultMemory    = "2048"  // Mb
 )
 
 type SSH struct {
 	User string `yaml:"user,omitempty"`
 	Port string `yaml:"port,omitempty"`
 	Pass string `yaml:"pass,omitempty"`
+	// Host to connect to, defaults to 127.0.0.1.
+	Host string `yaml:"host,omitempty"`
+	// Shell used to run commands as root, defaults to /bin/sh.
+	Shell string `yaml:"shell,omitempty"`
+
+	// PortMin and PortMax bound the range the local SSH port is picked
+	// from when Port is not set. Any free port is used by default.
+	PortMin int `yaml:"portMin,omitempty"`
+	PortMax int `yaml:"portMax,omitempty"`
+
+	// StrictHostKey verifies the machine host key against KnownHosts
+	// (defaults to ~/.ssh/known_hosts). Host keys are not checked by default.
+	StrictHostKey bool   `yaml:"strictHostKey,omitempty"`
+	KnownHosts    string `yaml:"knownHosts,omitempty"`
+	// HostKeyCallback, if set, takes precedence over StrictHostKey.
+	HostKeyCallback ssh.HostKeyCallback `yaml:"-"`
+
+	// Ciphers and KeyExchanges restrict the allowed algorithms, defaults are used when empty.
+	Ciphers      []string `yaml:"ciphers,omitempty"`
+	KeyExchanges []string `yaml:"keyExchanges,omitempty"`
+}
+
+// DriveConfig describes a disk attached to a QEMU machine.
+type DriveConfig struct {
+	// Path is a disk image, or a host block device like /dev/mapper/vg-lv,
+	// which is passed through as a raw disk (only for qemu).
+	Path string `yaml:"path,omitempty"`
+	// BootIndex sets the firmware boot priority of the disk (lower boots first).
+	// When 0, disks are ordered as they are listed.
+	BootIndex int `yaml:"bootindex,omitempty"`
+	// Interface is the bus the disk is attached to: "virtio" (default), "scsi", "nvme" or "ide".
+	Interface string `yaml:"interface,omitempty"`
+	// Encryption opens a LUKS encrypted qcow2 disk, see QEMU.CreateEncryptedDisk.
+	Encryption *DriveEncryption `yaml:"encryption,omitempty"`
+}
+
+// DriveEncryption holds the passphrase of an encrypted disk.
+type DriveEncryption struct {
+	Passphrase string `yaml:"passphrase,omitempty"`
+}
+
+// FwCfg is an entry exposed to the guest through the qemu fw_cfg interface,
+// with the content of either File or String.
+type FwCfg struct {
+	// Name must start with "opt/", e.g. "opt/org.example/config"
+	Name   string `yaml:"name,omitempty"`
+	File   string `yaml:"file,omitempty"`
+	String string `yaml:"string,omitempty"`
+}
+
+// DeviceSpec is a device added to the machine with -device driver,prop=value,...
+type DeviceSpec struct {
+	Driver     string            `yaml:"driver,omitempty"`
+	Properties map[string]string `yaml:"properties,omitempty"`
+}
+
+// NIC is an additional network interface of the machine (only for qemu).
+type NIC struct {
+	// Mode is "user" (default), for a NAT network without port forwards, or
+	// "tap" to attach the NIC to the existing host tap interface Tap, e.g. to
+	// connect several machines through a bridge.
+	Mode string `yaml:"mode,omitempty"`
+	Tap  string `yaml:"tap,omitempty"`
+	// Model defaults to virtio-net-pci.
+	Model string `yaml:"model,omitempty"`
+	MAC   string `yaml:"mac,omitempty"`
+
+	// Delay (e.g. "100ms"), Loss (a percentage) and Rate (e.g. "10mbit")
+	// shape the traffic sent to the guest with netem, only for tap NICs. They
+	// are applied on the host tap interface, which requires root.
+	Delay string  `yaml:"delay,omitempty"`
+	Loss  float64 `yaml:"loss,omitempty"`
+	Rate  string  `yaml:"rate,omitempty"`
+
+	// Vhost moves the virtio-net data path to the host kernel and Queues
+	// enables multiqueue with that many queue pairs, up to the vCPU count.
+	// Both are only supported by tap NICs with a virtio-net model.
+	Vhost  bool `yaml:"vhost,omitempty"`
+	Queues int  `yaml:"queues,omitempty"`
+}
+
+// RemoteHost is a host reachable over SSH, with key authentication, where qemu runs.
+type RemoteHost struct {
+	Host string `yaml:"host,omitempty"`
+	// Port defaults to 22.
+	Port string `yaml:"port,omitempty"`
+	User string `yaml:"user,omitempty"`
+	// Key is the path to the private key used to authenticate.
+	Key string `yaml:"key,omitempty"`
+	// KnownHosts verifies the host key of the remote host, which is not checked if empty.
+	KnownHosts string `yaml:"knownHosts,omitempty"`
+}
+
+// Sandbox confines qemu with seccomp filters. Each knob is "allow" or "deny",
+// and defaults to "deny". Spawn and ResourceControl break some features,
+// e.g. helper programs like qemu-bridge-helper, so they can be relaxed.
+type Sandbox struct {
+	Obsolete          string `yaml:"obsolete,omitempty"`
+	ElevatePrivileges string `yaml:"elevatePrivileges,omitempty"`
+	Spawn             string `yaml:"spawn,omitempty"`
+	ResourceControl   string `yaml:"resourceControl,omitempty"`
+}
+
+// MonitorTLS secures a TCP qemu monitor with TLS.
+type MonitorTLS struct {
+	// CredsDir is the directory, on the host running qemu, with the ca-cert.pem,
+	// server-cert.pem and server-key.pem files used by qemu.
+	CredsDir string `yaml:"credsDir,omitempty"`
+	// CACert verifies the certificate of qemu, system roots are used when empty.
+	CACert string `yaml:"caCert,omitempty"`
+	// ClientCert and ClientKey authenticate peg to qemu. When set, qemu
+	// requires clients to present a certificate signed by its CA.
+	ClientCert string `yaml:"clientCert,omitempty"`
+	ClientKey  string `yaml:"clientKey,omitempty"`
+	// ServerName overrides the name checked in the qemu certificate,
+	// it defaults to the host of MonitorAddr.
+	ServerName string `yaml:"serverName,omitempty"`
 }
 
 type MachineConfig struct {
@@ -34,9 +152,136 @@ type MachineConfig struct {
 	Process        string   `yaml:"bin,omitempty"`
 	Args           []string `yaml:"args,omitempty"`
 	// only for qemu
-	Display string `yaml:"display,omitempty"`
-
-	CPUType string `yaml:"cpu,omitempty"`
+	Display string        `yaml:"display,omitempty"`
+	Disks   []DriveConfig `yaml:"disks,omitempty"`
+
+	// SerialLogFile is where the output of the serial console is written (only
+	// for qemu). By default it goes to the stdout file of the state dir when no
+	// Display is set.
+	SerialLogFile string `yaml:"serialLogFile,omitempty"`
+	// SerialLogMaxBytes caps the size of SerialLogFile, which is periodically
+	// trimmed to its most recent SerialLogMaxBytes bytes. Zero disables it.
+	SerialLogMaxBytes int64 `yaml:"serialLogMaxBytes,omitempty"`
+
+	// Consoles are the names of virtio consoles to add, e.g. for a test agent
+	// in the guest to report its status, see QEMU.ReadConsole (only for qemu).
+	Consoles []string `yaml:"consoles,omitempty"`
+	// Channels are the names of virtio-serial ports to add, showing up in the
+	// guest as /dev/virtio-ports/<name>, see QEMU.ChannelSocketPath (only for qemu).
+	Channels []string `yaml:"channels,omitempty"`
+	// GuestAgentSocket is where the socket of the guest agent channel is
+	// created, by default inside the state dir (only for qemu).
+	GuestAgentSocket string `yaml:"guestAgentSocket,omitempty"`
+
+	// VGA selects the display adapter: "std", "virtio" or "qxl" (only for qemu).
+	// It composes with Display, which should then not set -vga itself.
+	// When running headless (no Display) on x86_64 it defaults to "std", as
+	// -nographic alone can produce empty screenshots.
+	VGA string `yaml:"vga,omitempty"`
+	// Resolution is the initial resolution of the VGA adapter, e.g. "1280x800".
+	Resolution string `yaml:"resolution,omitempty"`
+
+	// RemoteHost runs qemu on another host over SSH (only for qemu). The state
+	// dir, disks and ISOs are paths on the remote host, and the guest is reached
+	// through the SSH port forwarded there. Set MonitorAddr to a TCP address for
+	// monitor based features to work.
+	RemoteHost *RemoteHost `yaml:"remoteHost,omitempty"`
+
+	// FwCfg entries are passed to the guest with -fw_cfg (only for qemu).
+	FwCfg []FwCfg `yaml:"fwcfg,omitempty"`
+
+	// PCIPassthrough lists host PCI addresses (e.g. "0000:01:00.0") passed to the
+	// guest with vfio (only for qemu). Devices must be bound to the vfio-pci driver.
+	PCIPassthrough []string `yaml:"pciPassthrough,omitempty"`
+
+	// CPUSockets, CPUCores and CPUThreads set the CPU topology (only for qemu).
+	// When CPUCores is not set, CPU is the total number of vCPUs and is split
+	// evenly between the sockets and threads, both defaulting to 1. Otherwise
+	// CPU, if set, must match sockets*cores*threads.
+	CPUSockets int `yaml:"cpuSockets,omitempty"`
+	CPUCores   int `yaml:"cpuCores,omitempty"`
+	CPUThreads int `yaml:"cpuThreads,omitempty"`
+
+	// NoReboot makes qemu exit when the guest reboots, instead of resetting it (only for qemu).
+	NoReboot bool `yaml:"noReboot,omitempty"`
+	// PanicAction is what qemu does when the guest panics: "pause", "shutdown",
+	// "exit-failure" or "none" (only for qemu). With "exit-failure" a panic makes
+	// qemu exit with an error, calling OnFailure. It adds a pvpanic device, the
+	// guest kernel needs the pvpanic driver for it to work.
+	PanicAction string `yaml:"panicAction,omitempty"`
+
+	// Devices are added to the machine (only for qemu). Use Args for other options.
+	Devices []DeviceSpec `yaml:"devices,omitempty"`
+
+	// NICs are added after the default network, if any.
+	NICs []NIC `yaml:"nics,omitempty"`
+
+	// MemLock locks the guest memory in host RAM so that it is never swapped,
+	// and MemPrealloc allocates it all upfront, so that a host running out of
+	// memory fails on start instead of later on (only for qemu).
+	MemLock     bool `yaml:"memLock,omitempty"`
+	MemPrealloc bool `yaml:"memPrealloc,omitempty"`
+
+	// Sandbox, when set, runs qemu with -sandbox on (only for qemu).
+	Sandbox *Sandbox `yaml:"sandbox,omitempty"`
+
+	// Cgroup moves qemu to a cgroup v2 limiting its CPU and memory to the
+	// ones of the machine, plus some overhead, so that a runaway guest can't
+	// starve the host (only for qemu). The cgroup is created in CgroupParent,
+	// /sys/fs/cgroup/peg by default, which requires root.
+	Cgroup       bool   `yaml:"cgroup,omitempty"`
+	CgroupParent string `yaml:"cgroupParent,omitempty"`
+
+	// CreateRetries is how many times Create retries launching qemu when it
+	// fails because of a busy resource, e.g. a port in use (only for qemu).
+	CreateRetries int `yaml:"createRetries,omitempty"`
+
+	// RTCBase and RTCClock feed qemu's -rtc option (only for qemu).
+	// RTCBase can be "utc", "localtime" or a date like "2006-01-02T15:04:05".
+	// They default to "utc" and "rt".
+	RTCBase  string `yaml:"rtcBase,omitempty"`
+	RTCClock string `yaml:"rtcClock,omitempty"`
+
+	// TempDir is used for scratch files (screenshots, generated state dirs).
+	// Defaults to os.TempDir() when empty. On hosts where AppArmor or SELinux
+	// prevent qemu from opening files in arbitrary paths, set it to a location
+	// allowed by the policy (e.g. /var/lib/libvirt/images) so that disks and
+	// other files of the machine are created there.
+	TempDir string `yaml:"tempdir,omitempty"`
+
+	// MonitorAddr overrides where the qemu monitor listens (only for qemu).
+	// A "host:port" value makes the monitor listen on TCP, any other value
+	// is used as a unix socket path. Defaults to a socket in the state dir.
+	MonitorAddr string `yaml:"monitorAddr,omitempty"`
+	// MonitorTLS enables TLS on a TCP monitor. It is an error to set it
+	// with a unix socket MonitorAddr.
+	MonitorTLS *MonitorTLS `yaml:"monitorTLS,omitempty"`
+
+	CPUType string `yaml:"cpuType,omitempty"`
+	// CPUPin restricts the qemu process to the given host CPUs (only for qemu).
+	CPUPin []int `yaml:"cpuPin,omitempty"`
+
+	// Hostname is passed to the guest as a systemd credential via SMBIOS
+	// (only for qemu). It is honoured by guests running systemd >= 254,
+	// other images can use matcher's SetHostname once booted.
+	Hostname string `yaml:"hostname,omitempty"`
+
+	// UUID is the SMBIOS system UUID of the machine (only for qemu).
+	UUID string `yaml:"uuid,omitempty"`
+	// Seed makes the identity of the machine deterministic (only for qemu):
+	// when set, the UUID, if not given, and the MAC addresses of NICs without
+	// one are derived from it. The ID is a good candidate.
+	Seed string `yaml:"seed,omitempty"`
+
+	// Name identifies the machine in the qemu command line and process name
+	// (only for qemu), defaults to the ID.
+	Name string `yaml:"name,omitempty"`
+
+	// CommandWrapper prefixes the commands run in the machine, e.g.
+	// "chroot /host sh -c" or "nsenter -t 1 -m -u -i -n sh -c". The command is
+	// passed to it as a single quoted argument. Commands run as root by the
+	// matcher are wrapped inside sudo, as in "sudo <wrapper> <shell>".
+	CommandWrapper string `yaml:"commandWrapper,omitempty"`
 
 	// Network configuration
 	DisableDefaultNetworking bool `yaml:"disable_default_networking,omitempty"`
@@ -45,7 +290,20 @@ type MachineConfig struct {
 	Engine Engine `yaml:"engine,omitempty"`
 	Arch   string `yaml:"arch,omitempty"`
 
-	OnFailure func(*process.Process)
+	// OnFailure is called with the machine when its process exits unexpectedly,
+	// that is with a non-zero exit code before Stop was called or the context
+	// given to Create was cancelled (only for qemu). It can be used to collect
+	// diagnostics, e.g. logs or screenshots.
+	OnFailure func(m Machine) `yaml:"-"`
+
+	// PostCreate is called with the machine by Create once it has been started,
+	// to run host side setup. If it fails, the machine is stopped and Create
+	// returns the error.
+	PostCreate func(m Machine) error `yaml:"-"`
+
+	// EventHandler is called at each milestone of the machine lifecycle, e.g.
+	// to build timelines of CI runs.
+	EventHandler func(Event) `yaml:"-"`
 }
 
 type Engine string
@@ -63,7 +321,7 @@ func DefaultMachineConfig() *MachineConfig {
 		AutoDriveSetup: true,
 		SSH:            &SSH{},
 		CPU:            "2",
-		Memory:         "2048",
+		Memory:         DefaultMemory,
 		Arch:           "x86_64",
 	}
 }
@@ -77,6 +335,42 @@ func (m *MachineConfig) Apply(opts ...MachineOption) error {
 	return nil
 }
 
+func WithUUID(uuid string) MachineOption {
+	return func(mc *MachineConfig) error {
+		if uuid != "" {
+			mc.UUID = uuid
+		}
+		return nil
+	}
+}
+
+func WithSeed(seed string) MachineOption {
+	return func(mc *MachineConfig) error {
+		if seed != "" {
+			mc.Seed = seed
+		}
+		return nil
+	}
+}
+
+func WithName(name string) MachineOption {
+	return func(mc *MachineConfig) error {
+		if name != "" {
+			mc.Name = name
+		}
+		return nil
+	}
+}
+
+func WithSSHShell(shell string) MachineOption {
+	return func(mc *MachineConfig) error {
+		if shell != "" {
+			mc.SSH.Shell = shell
+		}
+		return nil
+	}
+}
+
 func WithSSHPass(sshpass string) MachineOption {
 	return func(mc *MachineConfig) error {
 		if sshpass != "" {
@@ -86,13 +380,28 @@ func WithSSHPass(sshpass string) MachineOption {
 	}
 }
 
-func OnFailure(f func(*process.Process)) MachineOption {
+func OnFailure(f func(m Machine)) MachineOption {
 	return func(mc *MachineConfig) error {
 		mc.OnFailure = f
 		return nil
 	}
 }
 
+// WithEventHandler sets the function called with the lifecycle events of the machine.
+func WithEventHandler(f func(Event)) MachineOption {
+	return func(mc *MachineConfig) error {
+		mc.EventHandler = f
+		return nil
+	}
+}
+
+func WithPostCreate(f func(m Machine) error) MachineOption {
+	return func(mc *MachineConfig) error {
+		mc.PostCreate = f
+		return nil
+	}
+}
+
 func WithMemory(mem string) MachineOption {
 	return func(mc *MachineConfig) error {
 		if mem != "" {
@@ -102,6 +411,50 @@ func WithMemory(mem string) MachineOption {
 	}
 }
 
+func WithSerialLogFile(path string) MachineOption {
+	return func(mc *MachineConfig) error {
+		if path != "" {
+			mc.SerialLogFile = path
+		}
+		return nil
+	}
+}
+
+// WithConsole adds a virtio console called name (only for qemu).
+func WithConsole(name string) MachineOption {
+	return func(mc *MachineConfig) error {
+		mc.Consoles = append(mc.Consoles, name)
+		return nil
+	}
+}
+
+// WithChannel adds a virtio-serial port called name (only for qemu).
+func WithChannel(name string) MachineOption {
+	return func(mc *MachineConfig) error {
+		mc.Channels = append(mc.Channels, name)
+		return nil
+	}
+}
+
+// WithGuestAgentSocket sets the path of the guest agent socket (only for qemu).
+func WithGuestAgentSocket(path string) MachineOption {
+	return func(mc *MachineConfig) error {
+		mc.GuestAgentSocket = path
+		return nil
+	}
+}
+
+// WithSerialLogMaxBytes caps the size of the serial log file (only for qemu).
+func WithSerialLogMaxBytes(n int64) MachineOption {
+	return func(mc *MachineConfig) error {
+		if n < 0 {
+			return fmt.Errorf("invalid serial log size %d", n)
+		}
+		mc.SerialLogMaxBytes = n
+		return nil
+	}
+}
+
 func WithDisplay(display string) MachineOption {
 	return func(mc *MachineConfig) error {
 		if display != "" {
@@ -111,6 +464,24 @@ func WithDisplay(display string) MachineOption {
 	}
 }
 
+func WithVGA(vga string) MachineOption {
+	return func(mc *MachineConfig) error {
+		if vga != "" {
+			mc.VGA = vga
+		}
+		return nil
+	}
+}
+
+func WithResolution(res string) MachineOption {
+	return func(mc *MachineConfig) error {
+		if res != "" {
+			mc.Resolution = res
+		}
+		return nil
+	}
+}
+
 func WithDataSource(ds string) MachineOption {
 	return func(mc *MachineConfig) error {
 		if ds != "" {
@@ -129,6 +500,24 @@ func WithCPUType(cpu string) MachineOption {
 	}
 }
 
+// WithCPUTopology sets the number of CPU sockets, cores per socket and threads per core.
+// When cores is set, CPU is set to the total number of vCPUs as well, so a
+// later WithCPU has to match it.
+func WithCPUTopology(sockets, cores, threads int) MachineOption {
+	return func(mc *MachineConfig) error {
+		if sockets < 0 || cores < 0 || threads < 0 {
+			return fmt.Errorf("invalid CPU topology: %d sockets, %d cores, %d threads", sockets, cores, threads)
+		}
+		mc.CPUSockets = sockets
+		mc.CPUCores = cores
+		mc.CPUThreads = threads
+		if cores > 0 {
+			mc.CPU = fmt.Sprint(max(sockets, 1) * cores * max(threads, 1))
+		}
+		return nil
+	}
+}
+
 func WithCPU(cpu string) MachineOption {
 	return func(mc *MachineConfig) error {
 		if cpu != "" {
@@ -138,6 +527,18 @@ func WithCPU(cpu string) MachineOption {
 	}
 }
 
+func WithCPUPin(cpus ...int) MachineOption {
+	return func(mc *MachineConfig) error {
+		for _, c := range cpus {
+			if c < 0 {
+				return fmt.Errorf("invalid host CPU to pin: %d", c)
+			}
+		}
+		mc.CPUPin = append(mc.CPUPin, cpus...)
+		return nil
+	}
+}
+
 func WithISOChecksum(iso string) MachineOption {
 	return func(mc *MachineConfig) error {
 		if iso != "" {
@@ -178,6 +579,16 @@ func WithDrive(drive string) MachineOption {
 	}
 }
 
+func WithDriveConfig(d DriveConfig) MachineOption {
+	return func(mc *MachineConfig) error {
+		if d.Path != "" {
+			mc.Disks = append(mc.Disks, d)
+		}
+
+		return nil
+	}
+}
+
 func WithDriveSize(drivesize string) MachineOption {
 	return func(mc *MachineConfig) error {
 		if drivesize != "" {
@@ -228,6 +639,17 @@ func WithSSHPort(sshport string) MachineOption {
 	}
 }
 
+func WithSSHPortRange(min, max int) MachineOption {
+	return func(mc *MachineConfig) error {
+		if min > max {
+			return fmt.Errorf("invalid port range %d-%d", min, max)
+		}
+		mc.SSH.PortMin = min
+		mc.SSH.PortMax = max
+		return nil
+	}
+}
+
 func WithSSHUser(sshuser string) MachineOption {
 	return func(mc *MachineConfig) error {
 		if sshuser != "" {
@@ -246,6 +668,122 @@ func WithStateDir(dir string) MachineOption {
 	}
 }
 
+func WithTempDir(dir string) MachineOption {
+	return func(mc *MachineConfig) error {
+		if dir != "" {
+			mc.TempDir = dir
+		}
+		return nil
+	}
+}
+
+func WithHostname(hostname string) MachineOption {
+	return func(mc *MachineConfig) error {
+		if hostname != "" {
+			mc.Hostname = hostname
+		}
+		return nil
+	}
+}
+
+func WithMonitorAddr(addr string) MachineOption {
+	return func(mc *MachineConfig) error {
+		if addr != "" {
+			mc.MonitorAddr = addr
+		}
+		return nil
+	}
+}
+
+func WithRTCBase(base string) MachineOption {
+	return func(mc *MachineConfig) error {
+		if base != "" {
+			mc.RTCBase = base
+		}
+		return nil
+	}
+}
+
+func WithRTCClock(clock string) MachineOption {
+	return func(mc *MachineConfig) error {
+		if clock != "" {
+			mc.RTCClock = clock
+		}
+		return nil
+	}
+}
+
+func WithCreateRetries(retries int) MachineOption {
+	return func(mc *MachineConfig) error {
+		if retries < 0 {
+			return fmt.Errorf("invalid number of retries: %d", retries)
+		}
+		mc.CreateRetries = retries
+		return nil
+	}
+}
+
+func WithRemoteHost(r *RemoteHost) MachineOption {
+	return func(mc *MachineConfig) error {
+		if r != nil {
+			mc.RemoteHost = r
+		}
+		return nil
+	}
+}
+
+func WithFwCfg(f FwCfg) MachineOption {
+	return func(mc *MachineConfig) error {
+		if f.Name != "" {
+			mc.FwCfg = append(mc.FwCfg, f)
+		}
+		return nil
+	}
+}
+
+func WithPanicAction(action string) MachineOption {
+	return func(mc *MachineConfig) error {
+		switch action {
+		case "", "pause", "shutdown", "exit-failure", "none":
+			mc.PanicAction = action
+			return nil
+		}
+		return fmt.Errorf("invalid panic action %q", action)
+	}
+}
+
+func WithDevice(d DeviceSpec) MachineOption {
+	return func(mc *MachineConfig) error {
+		mc.Devices = append(mc.Devices, d)
+		return nil
+	}
+}
+
+func WithNIC(n NIC) MachineOption {
+	return func(mc *MachineConfig) error {
+		mc.NICs = append(mc.NICs, n)
+		return nil
+	}
+}
+
+func WithPCIPassthrough(addr string) MachineOption {
+	return func(mc *MachineConfig) error {
+		if addr != "" {
+			mc.PCIPassthrough = append(mc.PCIPassthrough, addr)
+		}
+		return nil
+	}
+}
+
+func WithMonitorTLS(t *MonitorTLS) MachineOption {
+	return func(mc *MachineConfig) error {
+		if t != nil {
+			mc.MonitorTLS = t
+		}
+		return nil
+	}
+}
+
 func WithArch(arch string) MachineOption {
 	return func(mc *MachineConfig) error {
 		if arch != "" {
@@ -291,3 +829,39 @@ var EnableDefaultNetworking MachineOption = func(mc *MachineConfig) error {
 	mc.DisableDefaultNetworking = false
 	return nil
 }
+
+// DisableReboot makes qemu exit when the guest reboots.
+var DisableReboot MachineOption = func(mc *MachineConfig) error {
+	mc.NoReboot = true
+	return nil
+}
+
+// WithSandbox confines qemu with seccomp (only for qemu).
+func WithSandbox(s Sandbox) MachineOption {
+	return func(mc *MachineConfig) error {
+		mc.Sandbox = &s
+		return nil
+	}
+}
+
+// WithCgroup limits the resources of qemu with a cgroup created in parent,
+// the default one when empty (only for qemu).
+func WithCgroup(parent string) MachineOption {
+	return func(mc *MachineConfig) error {
+		mc.Cgroup = true
+		mc.CgroupParent = parent
+		return nil
+	}
+}
+
+// LockMemory prevents the guest memory from being swapped (only for qemu).
+var LockMemory MachineOption = func(mc *MachineConfig) error {
+	mc.MemLock = true
+	return nil
+}
+
+// PreallocMemory allocates the guest memory when qemu starts (only for qemu).
+var PreallocMemory MachineOption = func(mc *MachineConfig) error {
+	mc.MemPrealloc = true
+	return nil
+}
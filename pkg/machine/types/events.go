@@ -0,0 +1,33 @@
+package types
+
+import "time"
+
+// EventKind identifies a milestone in the lifecycle of a machine.
+type EventKind string
+
+const (
+	// EventDiskCreated is emitted for each disk created for the machine, with its path.
+	EventDiskCreated EventKind = "disk-created"
+	// EventProcessStarted is emitted once the machine process (or container) is running.
+	EventProcessStarted EventKind = "process-started"
+	// EventSSHReady is emitted once the machine accepts SSH connections.
+	EventSSHReady EventKind = "ssh-ready"
+	// EventFailed is emitted when creating the machine fails, or its process
+	// exits unexpectedly, with the error.
+	EventFailed EventKind = "failed"
+)
+
+// Event is a lifecycle milestone of a machine, passed to MachineConfig.EventHandler.
+type Event struct {
+	Kind      EventKind
+	Timestamp time.Time
+	Detail    string
+}
+
+// Emit calls the EventHandler of the machine, if any, with a new event.
+func (mc MachineConfig) Emit(kind EventKind, detail string) {
+	if mc.EventHandler == nil {
+		return
+	}
+	mc.EventHandler(Event{Kind: kind, Timestamp: time.Now(), Detail: detail})
+}
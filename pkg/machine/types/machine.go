@@ -14,3 +14,10 @@ type Machine interface {
 	ReceiveFile(src, dst string) error
 	SendFile(src, dst, permissions string) error
 }
+
+// ContextCommander is implemented by the machines which can give up on a
+// command when a context is done.
+type ContextCommander interface {
+	// CommandContext is like Command, giving up on cmd when ctx is done.
+	CommandContext(ctx context.Context, cmd string) (string, error)
+}
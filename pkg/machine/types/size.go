@@ -0,0 +1,46 @@
+package types
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// sizeUnits are the suffixes accepted by ParseSizeMiB, in MiB. Like qemu,
+// M and G are binary units.
+var sizeUnits = map[string]float64{
+	"":    1,
+	"M":   1,
+	"MB":  1,
+	"MIB": 1,
+	"G":   1024,
+	"GB":  1024,
+	"GIB": 1024,
+	"T":   1024 * 1024,
+	"TB":  1024 * 1024,
+	"TIB": 1024 * 1024,
+}
+
+// ParseSizeMiB parses a memory or disk size like "2G", "2048M", "2048MB" or
+// "2048", bare numbers being MiB, and returns it in MiB.
+func ParseSizeMiB(s string) (uint64, error) {
+	size := strings.ToUpper(strings.TrimSpace(s))
+	i := strings.IndexFunc(size, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if i == -1 {
+		i = len(size)
+	}
+
+	unit, ok := sizeUnits[strings.TrimSpace(size[i:])]
+	n, err := strconv.ParseFloat(size[:i], 64)
+	if !ok || err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+
+	mib := n * unit
+	if mib != float64(uint64(mib)) {
+		return 0, fmt.Errorf("invalid size %q: not a whole number of MiB", s)
+	}
+	return uint64(mib), nil
+}
@@ -35,22 +35,51 @@ func (v *VBox) Clean() error {
 	if err := os.RemoveAll(v.machineConfig.StateDir); err != nil {
 		return err
 	}
+	unregister(v)
 	//utils.SH(fmt.Sprintf("rm -rf ~/VirtualBox\\ VMs/%s", ID))
 	return nil
 }
 
 func (v *VBox) CreateDisk(diskname, size string) error {
 	_, err := utils.SH(fmt.Sprintf("VBoxManage createmedium disk --filename %s --size %s", filepath.Join(v.machineConfig.StateDir, diskname), size))
-	return err
+	if err != nil {
+		return withKind(ErrDiskCreate, err)
+	}
+	v.machineConfig.Emit(types.EventDiskCreated, filepath.Join(v.machineConfig.StateDir, diskname))
+	return nil
 }
 
 func (v *VBox) Create(ctx context.Context) (context.Context, error) {
+	release, err := acquireCreate(ctx)
+	if err != nil {
+		return ctx, err
+	}
+	ctx, err = v.create(ctx)
+	// The VM is running, don't hold the slot through a slow PostCreate
+	release()
+	if err == nil {
+		err = postCreate(v) // TODO: Nothing monitors the vm process. The context won't be "Done" if it exits
+	}
+	return ctx, failed(v.machineConfig, err)
+}
+
+func (v *VBox) create(ctx context.Context) (context.Context, error) {
+	mem, err := memoryMiB(v.machineConfig)
+	if err != nil {
+		return ctx, err
+	}
+	driveSizes, err := v.driveSizes()
+	if err != nil {
+		return ctx, err
+	}
+
+	register(v)
 	out, err := utils.SH(fmt.Sprintf("VBoxManage createvm --name %[1]s --uuid %[1]s --register", v.machineConfig.ID))
 	if err != nil {
 		return ctx, fmt.Errorf("while creating VM: %w - %s", err, out)
 	}
 
-	out, err = utils.SH(fmt.Sprintf("VBoxManage modifyvm %s --memory %s --cpus %s", v.machineConfig.ID, v.machineConfig.Memory, v.machineConfig.CPU))
+	out, err = utils.SH(fmt.Sprintf("VBoxManage modifyvm %s --memory %d --cpus %s", v.machineConfig.ID, mem, v.machineConfig.CPU))
 	if err != nil {
 		return ctx, fmt.Errorf("while set VM: %w - %s", err, out)
 	}
@@ -65,7 +94,6 @@ func (v *VBox) Create(ctx context.Context) (context.Context, error) {
 		return ctx, fmt.Errorf("while set VM: %w - %s", err, out)
 	}
 
-	driveSizes := v.driveSizes()
 	userDrives := v.machineConfig.Drives
 	if v.machineConfig.AutoDriveSetup && len(userDrives) == 0 {
 		for i, s := range driveSizes {
@@ -106,12 +134,13 @@ func (v *VBox) Create(ctx context.Context) (context.Context, error) {
 	if err != nil {
 		return ctx, fmt.Errorf("while set VM: %w - %s", err, out)
 	}
+	v.machineConfig.Emit(types.EventProcessStarted, v.machineConfig.ID)
 
-	return ctx, nil // TODO: Nothing monitors the vm process. The context won't be "Done" if it exits
+	return ctx, nil
 }
 
 func (v *VBox) Screenshot() (string, error) {
-	f, err := ioutil.TempFile("", "fff")
+	f, err := ioutil.TempFile(tempDir(v.machineConfig), "fff")
 	if err != nil {
 		return "", err
 	}
@@ -136,6 +165,10 @@ func (v *VBox) Command(cmd string) (string, error) {
 	return controller.SSHCommand(v, cmd)
 }
 
+func (v *VBox) CommandContext(ctx context.Context, cmd string) (string, error) {
+	return controller.SSHCommandContext(ctx, v, cmd)
+}
+
 func (v *VBox) ReceiveFile(src, dst string) error {
 	return controller.ReceiveFile(v, src, dst)
 }
@@ -144,10 +177,19 @@ func (v *VBox) SendFile(src, dst, permissions string) error {
 	return controller.SendFile(v, src, dst, permissions)
 }
 
-func (v *VBox) driveSizes() []string {
-	if len(v.machineConfig.DriveSizes) != 0 {
-		return v.machineConfig.DriveSizes
+// driveSizes returns the drive sizes in Mb, as VBoxManage expects them.
+func (v *VBox) driveSizes() ([]string, error) {
+	if len(v.machineConfig.DriveSizes) == 0 {
+		return []string{types.DefaultDriveSize}, nil
 	}
 
-	return []string{types.DefaultDriveSize}
+	sizes := []string{}
+	for _, s := range v.machineConfig.DriveSizes {
+		mib, err := types.ParseSizeMiB(s)
+		if err != nil {
+			return nil, fmt.Errorf("drive size: %w", err)
+		}
+		sizes = append(sizes, fmt.Sprint(mib))
+	}
+	return sizes, nil
 }
@@ -0,0 +1,57 @@
+package machine
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+var qemuVersionRe = regexp.MustCompile(`QEMU emulator version (\d+)\.(\d+)(\.\d+)?`)
+
+// Version returns the version of the qemu binary used by the machine, e.g. "8.2.2".
+func (q *QEMU) Version() (string, error) {
+	q.versionLock.Lock()
+	defer q.versionLock.Unlock()
+
+	if q.version != "" {
+		return q.version, nil
+	}
+
+	bin, err := q.binary()
+	if err != nil {
+		return "", err
+	}
+	out, err := q.hostSH(fmt.Sprintf("%s --version", shellQuote(bin)))
+	if err != nil {
+		return "", fmt.Errorf("getting qemu version: %w - %s", err, out)
+	}
+
+	m := qemuVersionRe.FindStringSubmatch(out)
+	if m == nil {
+		return "", fmt.Errorf("unexpected qemu version output: %s", out)
+	}
+	q.version = m[1] + "." + m[2] + m[3]
+	return q.version, nil
+}
+
+// requireVersion returns an error if the qemu version is older than major.minor,
+// which is needed by feature.
+func (q *QEMU) requireVersion(feature string, major, minor int) error {
+	v, err := q.Version()
+	if err != nil {
+		return err
+	}
+	m := qemuVersionRe.FindStringSubmatch("QEMU emulator version " + v)
+	gotMajor, err := strconv.Atoi(m[1])
+	if err != nil {
+		return fmt.Errorf("parsing qemu version %s: %w", v, err)
+	}
+	gotMinor, err := strconv.Atoi(m[2])
+	if err != nil {
+		return fmt.Errorf("parsing qemu version %s: %w", v, err)
+	}
+	if gotMajor < major || (gotMajor == major && gotMinor < minor) {
+		return fmt.Errorf("%s requires qemu >= %d.%d, found %s", feature, major, minor, v)
+	}
+	return nil
+}
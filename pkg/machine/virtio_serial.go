@@ -0,0 +1,123 @@
+package machine
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// virtioSerialBus is the id of the virtio-serial controller all ports are attached to.
+const virtioSerialBus = "vser0"
+
+// portName matches the names accepted for virtio consoles and channels.
+var portName = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
+
+// virtioPort is a port of the virtio-serial controller, backed by a unix
+// socket on the host.
+type virtioPort struct {
+	// id is the id of the chardev, unique among ports
+	id string
+	// name is how the port is known in the guest, unique among ports
+	name string
+	// device is either virtserialport or virtconsole
+	device string
+	sock   string
+}
+
+// virtioPorts returns the registry of the virtio-serial ports of the machine:
+// the guest agent channel, the consoles and the user channels.
+func (q *QEMU) virtioPorts() ([]virtioPort, error) {
+	mc := q.machineConfig
+	if mc.RemoteHost != nil {
+		if len(mc.Consoles) > 0 {
+			return nil, errors.New("virtio consoles are not supported with a remote host")
+		}
+		if len(mc.Channels) > 0 {
+			return nil, errors.New("virtio channels are not supported with a remote host")
+		}
+		return nil, nil
+	}
+
+	ports := []virtioPort{{
+		id:     "qga0",
+		name:   "org.qemu.guest_agent.0",
+		device: "virtserialport",
+		sock:   q.guestAgentSockFile(),
+	}}
+	for _, name := range mc.Consoles {
+		if !portName.MatchString(name) {
+			return nil, fmt.Errorf("invalid console name %q", name)
+		}
+		ports = append(ports, virtioPort{id: "con-" + name, name: name, device: "virtconsole", sock: q.consoleSockFile(name)})
+	}
+	for _, name := range mc.Channels {
+		if !portName.MatchString(name) {
+			return nil, fmt.Errorf("invalid channel name %q", name)
+		}
+		ports = append(ports, virtioPort{id: "chan-" + name, name: name, device: "virtserialport", sock: q.channelSockFile(name)})
+	}
+
+	seen := map[string]bool{}
+	for _, p := range ports {
+		if seen[p.name] {
+			return nil, fmt.Errorf("duplicate virtio-serial port name %q", p.name)
+		}
+		seen[p.name] = true
+	}
+	return ports, nil
+}
+
+// virtioSerialOpts returns the qemu options adding the virtio-serial
+// controller and its ports.
+func (q *QEMU) virtioSerialOpts() ([]string, error) {
+	ports, err := q.virtioPorts()
+	if err != nil {
+		return nil, err
+	}
+
+	opts := []string{"-device", "virtio-serial,id=" + virtioSerialBus}
+	for _, p := range ports {
+		opts = append(opts,
+			"-chardev", fmt.Sprintf("socket,path=%s,server=on,wait=off,id=%s", qemuOptEscape(p.sock), p.id),
+			"-device", fmt.Sprintf("%s,bus=%s.0,chardev=%s,name=%s", p.device, virtioSerialBus, p.id, p.name),
+		)
+	}
+	return opts, nil
+}
+
+// qemuOptEscape escapes s to be used as the value of a qemu option, where a
+// comma would start the next option.
+func qemuOptEscape(s string) string {
+	return strings.ReplaceAll(s, ",", ",,")
+}
+
+// channelSockFile returns the socket of the channel name inside the state dir.
+func (q *QEMU) channelSockFile(name string) string {
+	return path.Join(q.machineConfig.StateDir, fmt.Sprintf("channel-%s.sock", name))
+}
+
+// GuestAgentSocketPath returns the path of the socket of the guest agent channel.
+func (q *QEMU) GuestAgentSocketPath() string {
+	return q.guestAgentSockFile()
+}
+
+// ConsoleSocketPath returns the path of the socket of the virtio console name.
+func (q *QEMU) ConsoleSocketPath(name string) (string, error) {
+	if !slices.Contains(q.machineConfig.Consoles, name) {
+		return "", fmt.Errorf("the machine has no console %q", name)
+	}
+	return q.consoleSockFile(name), nil
+}
+
+// ChannelSocketPath returns the path of the socket of the channel name. The
+// guest reads and writes /dev/virtio-ports/<name>, one client at a time can
+// connect to the socket on the host.
+func (q *QEMU) ChannelSocketPath(name string) (string, error) {
+	if !slices.Contains(q.machineConfig.Channels, name) {
+		return "", fmt.Errorf("the machine has no channel %q", name)
+	}
+	return q.channelSockFile(name), nil
+}